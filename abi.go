@@ -0,0 +1,96 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"go/types"
+	"strings"
+)
+
+// The ABI type describes the target for which sizes, offsets and
+// alignments are computed.
+type ABI struct {
+	// The compiler whose layout rules are used, "gc" or "gccgo".
+	Compiler string
+	// The target architecture, a GOARCH value.
+	Arch string
+	// Packed is true if structs are laid out without padding.
+	Packed bool
+	// WordSize is the size, in bytes, of a machine word.
+	WordSize int
+}
+
+// String returns the ABI in the form accepted by the -arch option,
+// with a ",packed" suffix for packed layouts.
+func (abi ABI) String() string {
+	s := abi.Compiler + "/" + abi.Arch
+	if abi.Packed {
+		s += ",packed"
+	}
+	return s
+}
+
+// TargetABI is the ABI used for all layout computations. It is set,
+// along with Sizer, by SetABI.
+var TargetABI = ABI{"gc", "amd64", false, 8}
+
+// SetABI selects the target ABI. The target is a GOARCH value,
+// optionally prefixed by a compiler name and a slash, e.g. "arm" or
+// "gccgo/arm", and must be supported by types.SizesFor. If packed is
+// true structs are laid out without any padding.
+func SetABI(target string, packed bool) error {
+	compiler, arch := "gc", target
+	if i := strings.IndexByte(target, '/'); i != -1 {
+		compiler, arch = target[:i], target[i+1:]
+	}
+	sizes := types.SizesFor(compiler, arch)
+	if sizes == nil {
+		return fmt.Errorf("%s: unsupported target architecture", target)
+	}
+	if packed {
+		sizes = packedSizes{sizes}
+	}
+	Sizer = sizes
+	TargetABI = ABI{compiler, arch, packed, int(sizes.Sizeof(types.Typ[types.Uintptr]))}
+	return nil
+}
+
+// packedSizes implements types.Sizes for a packed layout, one without
+// padding. The sizes of basic types are those of the underlying Sizes.
+type packedSizes struct {
+	types.Sizes
+}
+
+func (packedSizes) Alignof(types.Type) int64 {
+	return 1
+}
+
+func (s packedSizes) Offsetsof(fields []*types.Var) []int64 {
+	offsets := make([]int64, len(fields))
+	var offset int64
+	for i, field := range fields {
+		offsets[i] = offset
+		offset += s.Sizeof(field.Type())
+	}
+	return offsets
+}
+
+func (s packedSizes) Sizeof(t types.Type) int64 {
+	switch t := t.Underlying().(type) {
+	case *types.Array:
+		return t.Len() * s.Sizeof(t.Elem())
+	case *types.Struct:
+		var size int64
+		for i := 0; i < t.NumFields(); i++ {
+			size += s.Sizeof(t.Field(i).Type())
+		}
+		return size
+	}
+	return s.Sizes.Sizeof(t)
+}
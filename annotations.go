@@ -0,0 +1,196 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// AnnotationPrefix is the prefix of the directive comments used to
+// annotate declarations in .ridl files, e.g. "//ridl:id 42".
+const AnnotationPrefix = "//ridl:"
+
+// An Annotation is the value of a "//ridl:" directive comment attached
+// to a declaration. Value holds an int, a string or a bool according
+// to the key's AnnotationSpec.
+type Annotation struct {
+	Key      string
+	Value    interface{}
+	Position token.Position
+}
+
+// String returns the annotation's value as a string.
+func (a *Annotation) String() string {
+	return fmt.Sprint(a.Value)
+}
+
+// Annotations maps annotation keys to the annotations of a declaration.
+type Annotations map[string]*Annotation
+
+// AnnotationValue defines the type of an annotation's value.
+type AnnotationValue int
+
+const (
+	// AnnotationFlag annotations have no value, their Value is true.
+	AnnotationFlag AnnotationValue = iota
+	// AnnotationInt annotations have an integer value.
+	AnnotationInt
+	// AnnotationString annotations have an optional string value,
+	// either a Go string literal or the remaining text of the line.
+	AnnotationString
+)
+
+// An AnnotationSpec describes an annotation key, the type of its value
+// and the kinds of declaration it may be applied to. A nil Kinds
+// permits all kinds.
+type AnnotationSpec struct {
+	Value AnnotationValue
+	Kinds []DeclKind
+}
+
+// AnnotationRegistry holds the annotation keys ridl recognizes.
+// Annotations with other keys are errors.
+var AnnotationRegistry = map[string]AnnotationSpec{
+	"id":         {AnnotationInt, []DeclKind{DeclKindInterface, DeclKindMethod}},
+	"deprecated": {AnnotationString, nil},
+	"oneway":     {AnnotationFlag, []DeclKind{DeclKindMethod}},
+}
+
+// annotate parses the directive comments of every declaration in the
+// receiver, including struct fields, methods and method arguments,
+// and returns a Diagnostic for each one that is invalid.
+func (p *Package) annotate() Diagnostics {
+	var diagnostics Diagnostics
+	p.annotations = make(map[token.Pos]Annotations)
+	for _, d := range allDecls(p.Decls) {
+		obj := declObject(d)
+		annotations, errs := parseAnnotations(p.fset, p.comments[obj.Pos()].doc, d.Kind())
+		diagnostics = append(diagnostics, errs...)
+		if len(annotations) != 0 {
+			p.annotations[obj.Pos()] = annotations
+		}
+		if m, ok := d.(*MethodDecl); ok && annotations["oneway"] != nil && len(m.Results) != 0 {
+			message := fmt.Sprintf("method %s.%s: oneway methods may not have results", m.Interface.Name(), m.Name())
+			diagnostics = append(diagnostics, Diagnostic{annotations["oneway"].Position, message})
+		}
+	}
+	diagnostics.Sort()
+	return diagnostics
+}
+
+// parseAnnotations parses the annotation directives in a doc comment
+// for a declaration of the given kind.
+func parseAnnotations(fset *token.FileSet, doc *ast.CommentGroup, kind DeclKind) (Annotations, Diagnostics) {
+	if doc == nil {
+		return nil, nil
+	}
+	var diagnostics Diagnostics
+	annotations := make(Annotations)
+	for _, comment := range doc.List {
+		if !strings.HasPrefix(comment.Text, AnnotationPrefix) {
+			continue
+		}
+		position := fset.Position(comment.Pos())
+		errorf := func(format string, args ...interface{}) {
+			diagnostics = append(diagnostics, Diagnostic{position, fmt.Sprintf(format, args...)})
+		}
+		text := strings.TrimPrefix(comment.Text, AnnotationPrefix)
+		key, arg := text, ""
+		if i := strings.IndexAny(text, " \t"); i != -1 {
+			key, arg = text[:i], strings.TrimSpace(text[i+1:])
+		}
+		spec, known := AnnotationRegistry[key]
+		if !known {
+			errorf("unknown annotation %q", key)
+			continue
+		}
+		if !spec.appliesTo(kind) {
+			errorf("annotation %q cannot be applied to a %s", key, kind)
+			continue
+		}
+		if _, duplicate := annotations[key]; duplicate {
+			errorf("duplicate annotation %q", key)
+			continue
+		}
+		value, err := spec.parse(arg)
+		if err != nil {
+			errorf("annotation %q: %v", key, err)
+			continue
+		}
+		annotations[key] = &Annotation{key, value, position}
+	}
+	return annotations, diagnostics
+}
+
+func (spec AnnotationSpec) appliesTo(kind DeclKind) bool {
+	if spec.Kinds == nil {
+		return true
+	}
+	for _, k := range spec.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (spec AnnotationSpec) parse(arg string) (interface{}, error) {
+	switch spec.Value {
+	case AnnotationFlag:
+		if arg != "" {
+			return nil, fmt.Errorf("unexpected value %q", arg)
+		}
+		return true, nil
+	case AnnotationInt:
+		n, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", arg)
+		}
+		return int(n), nil
+	case AnnotationString:
+		if strings.HasPrefix(arg, `"`) || strings.HasPrefix(arg, "`") {
+			s, err := strconv.Unquote(arg)
+			if err != nil {
+				return nil, fmt.Errorf("malformed string %s", arg)
+			}
+			return s, nil
+		}
+		return arg, nil
+	}
+	panic(fmt.Errorf("bad AnnotationValue value == %d", int(spec.Value)))
+}
+
+// allDecls returns the given declarations together with all of their
+// nested declarations, struct fields, methods and method arguments.
+func allDecls(decls []Decl) []Decl {
+	var all []Decl
+	for _, d := range decls {
+		all = append(all, d)
+		switch d := d.(type) {
+		case *StructDecl:
+			for _, f := range d.Fields {
+				all = append(all, f)
+			}
+		case *InterfaceDecl:
+			for _, m := range d.OwnMethods {
+				all = append(all, m)
+				for _, arg := range m.Args {
+					all = append(all, arg)
+				}
+				for _, res := range m.Results {
+					all = append(all, res)
+				}
+			}
+		}
+	}
+	return all
+}
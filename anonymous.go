@@ -0,0 +1,165 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Target languages without anonymous struct types need a name for
+// each struct type written inline, as the type of a field, a method
+// argument or result, or an element, key or value of a composite
+// type. ridl synthesizes a StructDecl for each such struct type,
+// naming it after its use, e.g. Image_Meta for the Meta field of
+// Image. The structs of elements, keys and values are named by
+// adding _Elem, _Key or _Value, e.g. Image_Tags_Elem for a field Tags
+// of type []struct{...}. Synthesized structs have IsSynthesized set
+// and are declared immediately ahead of the declaration using them.
+// Empty struct types, struct{}, are not named so map[K]struct{}
+// remains a set.
+
+// structPositions returns the positions of the struct type literals
+// in the given files indexed by their types.
+func structPositions(files []*ast.File, info *types.Info) map[*types.Struct]token.Pos {
+	positions := make(map[*types.Struct]token.Pos)
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			if expr, ok := n.(*ast.StructType); ok {
+				if s, ok := info.TypeOf(expr).(*types.Struct); ok {
+					positions[s] = expr.Pos()
+				}
+			}
+			return true
+		})
+	}
+	return positions
+}
+
+// synthesizeStructs declares a StructDecl for each anonymous struct
+// type used by the receiver's declarations.
+func (p *Package) synthesizeStructs(positions map[*types.Struct]token.Pos) {
+	s := &synthesizer{pkg: p, positions: positions, names: make(map[string]bool)}
+	p.anonymous = make(map[*types.Struct]*types.Named)
+	decls := p.Decls
+	p.Decls = nil
+	for _, d := range decls {
+		s.visitDecl(d)
+		p.Declare(d)
+	}
+}
+
+type synthesizer struct {
+	pkg       *Package
+	positions map[*types.Struct]token.Pos
+	names     map[string]bool
+}
+
+func (s *synthesizer) visitDecl(d Decl) {
+	switch d := d.(type) {
+	case *StructDecl:
+		for _, f := range d.OwnFields() {
+			s.visit(d.Name()+"_"+f.Name(), f.Object.Type())
+		}
+	case *InterfaceDecl:
+		for _, m := range d.OwnMethods {
+			for _, arg := range append(m.Args[:len(m.Args):len(m.Args)], m.Results...) {
+				s.visit(fmt.Sprintf("%s_%s_%s", d.Name(), m.Name(), arg.Name()), arg.Object.Type())
+			}
+		}
+	case *ArrayDecl, *MapDecl:
+		s.visitElems(d.Name(), declObject(d).Type().Underlying())
+	case *ValueDecl:
+		s.visit(d.Name()+"_Type", d.Object.Type())
+	}
+}
+
+// visit synthesizes a struct for t, or those within it, if it is an
+// anonymous struct type or composed of them.
+func (s *synthesizer) visit(name string, t types.Type) {
+	switch t := t.(type) {
+	case *types.Struct:
+		if _, found := s.pkg.anonymous[t]; !found && t.NumFields() > 0 {
+			s.synthesize(name, t)
+		}
+	case *types.Pointer:
+		s.visit(name, t.Elem())
+	case *types.Named:
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			s.visit(fmt.Sprintf("%s_Arg%d", name, i+1), t.TypeArgs().At(i))
+		}
+	default:
+		s.visitElems(name, t)
+	}
+}
+
+// visitElems visits the element, or key and value, types of an array,
+// slice or map type.
+func (s *synthesizer) visitElems(name string, t types.Type) {
+	switch t := t.(type) {
+	case *types.Array:
+		s.visit(name+"_Elem", t.Elem())
+	case *types.Slice:
+		s.visit(name+"_Elem", t.Elem())
+	case *types.Map:
+		s.visit(name+"_Key", t.Key())
+		s.visit(name+"_Value", t.Elem())
+	}
+}
+
+// synthesize declares a StructDecl, with a name unique within the
+// package, for the struct type t. Structs synthesized for the fields
+// of t are declared ahead of it.
+func (s *synthesizer) synthesize(name string, t *types.Struct) {
+	unique := name
+	for n := 2; s.names[unique] || s.pkg.types.Scope().Lookup(unique) != nil; n++ {
+		unique = fmt.Sprintf("%s%d", name, n)
+	}
+	s.names[unique] = true
+	obj := types.NewTypeName(s.positions[t], s.pkg.types, unique, nil)
+	s.pkg.anonymous[t] = types.NewNamed(obj, t, nil)
+	decl := makeStruct(s.pkg, obj, t).(*StructDecl)
+	decl.IsSynthesized = true
+	s.visitDecl(decl)
+	s.pkg.declare(obj, decl)
+}
+
+// nameAnonymous returns t with each anonymous struct type within it
+// replaced by the named type synthesized for it.
+func (p *Package) nameAnonymous(t types.Type) types.Type {
+	if len(p.anonymous) == 0 {
+		return t
+	}
+	switch t := t.(type) {
+	case *types.Struct:
+		if named, found := p.anonymous[t]; found {
+			return named
+		}
+	case *types.Pointer:
+		return types.NewPointer(p.nameAnonymous(t.Elem()))
+	case *types.Array:
+		return types.NewArray(p.nameAnonymous(t.Elem()), t.Len())
+	case *types.Slice:
+		return types.NewSlice(p.nameAnonymous(t.Elem()))
+	case *types.Map:
+		return types.NewMap(p.nameAnonymous(t.Key()), p.nameAnonymous(t.Elem()))
+	case *types.Named:
+		args := make([]types.Type, t.TypeArgs().Len())
+		for i := range args {
+			args[i] = p.nameAnonymous(t.TypeArgs().At(i))
+		}
+		if len(args) != 0 {
+			if instance, err := types.Instantiate(nil, t.Origin(), args, false); err == nil {
+				return instance
+			}
+		}
+	}
+	return t
+}
@@ -0,0 +1,137 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+)
+
+// declComments holds the doc and line comments associated with a
+// declaration.
+type declComments struct {
+	doc  *ast.CommentGroup
+	line *ast.CommentGroup
+}
+
+// collectComments walks the files' declarations and returns their
+// comments indexed by the position of the declared identifier, the
+// position go/types uses for the corresponding types.Object.
+//
+// A doc comment on an unparenthesized const or type declaration
+// applies to its single spec. The comments of a struct field or
+// method parameter apply to every name it declares.
+func collectComments(fset *token.FileSet, files []*ast.File) map[token.Pos]declComments {
+	comments := make(map[token.Pos]declComments)
+	record := func(pos token.Pos, doc, line *ast.CommentGroup) {
+		if doc != nil || line != nil {
+			comments[pos] = declComments{doc, line}
+		}
+	}
+	var cmap ast.CommentMap
+	recordFields := func(fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			doc, line := field.Doc, field.Comment
+			if doc == nil && line == nil {
+				// The parser does not attach comments to
+				// parameters, find them in the comment map.
+				doc, line = paramComments(fset, field, cmap[field])
+			}
+			if len(field.Names) == 0 {
+				record(fieldTypePos(field.Type), doc, line)
+			}
+			for _, name := range field.Names {
+				record(name.Pos(), doc, line)
+			}
+		}
+	}
+	for _, file := range files {
+		cmap = ast.NewCommentMap(fset, file, file.Comments)
+		for _, d := range file.Decls {
+			gen, ok := d.(*ast.GenDecl)
+			if !ok {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					doc := spec.Doc
+					if doc == nil && !gen.Lparen.IsValid() {
+						doc = gen.Doc
+					}
+					record(spec.Name.Pos(), doc, spec.Comment)
+					ast.Inspect(spec.Type, func(n ast.Node) bool {
+						switch n := n.(type) {
+						case *ast.StructType:
+							recordFields(n.Fields)
+						case *ast.InterfaceType:
+							recordFields(n.Methods)
+						case *ast.FuncType:
+							recordFields(n.Params)
+							recordFields(n.Results)
+						}
+						return true
+					})
+				case *ast.ValueSpec:
+					doc := spec.Doc
+					if doc == nil && !gen.Lparen.IsValid() {
+						doc = gen.Doc
+					}
+					for _, name := range spec.Names {
+						record(name.Pos(), doc, spec.Comment)
+					}
+				}
+			}
+		}
+	}
+	return comments
+}
+
+// paramComments returns the doc and line comments of a method parameter
+// from the comment groups associated with it by an ast.CommentMap. A
+// group that ends on the line before the parameter is its doc comment,
+// one that starts on the line the parameter ends is its line comment.
+func paramComments(fset *token.FileSet, field *ast.Field, groups []*ast.CommentGroup) (doc, line *ast.CommentGroup) {
+	start := fset.Position(field.Pos()).Line
+	end := fset.Position(field.End()).Line
+	for _, group := range groups {
+		switch {
+		case fset.Position(group.End()).Line == start-1:
+			doc = group
+		case fset.Position(group.Pos()).Line == end:
+			line = group
+		}
+	}
+	return doc, line
+}
+
+// fieldTypePos returns the position go/types gives the object of an
+// embedded field or unnamed parameter of the given type, that of the
+// type's name.
+func fieldTypePos(expr ast.Expr) token.Pos {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return fieldTypePos(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel.Pos()
+	}
+	return expr.Pos()
+}
+
+// commentText returns the text of a comment group without comment
+// markers or the trailing newline. Directive comments are excluded.
+func commentText(group *ast.CommentGroup) string {
+	if group == nil {
+		return ""
+	}
+	return strings.TrimSuffix(group.Text(), "\n")
+}
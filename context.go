@@ -38,6 +38,8 @@ type Context struct {
 	Username string
 	// The name of the host where processing is running.
 	Hostname string
+	// The ABI used to compute sizes, offsets and alignments.
+	ABI ABI
 	// The basic alias types, "typedefs", "type <ident> <type>"...
 	Typedefs []*TypedefDecl
 	// The array and slice types.
@@ -54,25 +56,40 @@ type Context struct {
 	Enums []*Enum
 	// NotEnums - constants that are not in Enums.
 	NotEnums []*ConstDecl
+	// Values, the variables initialized by composite literals.
+	Values []*ValueDecl
+	// DependencyOrder, all declarations with each following the
+	// types it references.
+	DependencyOrder []Decl
+	// Cycles, the declarations that reference each other, each in
+	// dependency order.
+	Cycles [][]Decl
+	// Messages, the requests and responses of the interfaces'
+	// methods.
+	Messages []*Message
 }
 
 // NewContext returns a new Context for the given file and Package.
 func NewContext(directory string, filenames []string, pkg *Package) *Context {
 	context := &Context{
-		RidlVersion: strings.TrimSpace(versionNumber),
-		Package:     pkg,
-		Directory:   directory,
-		Filenames:   filenames,
-		BuildTime:   time.Now(),
-		Username:    MustGetUsername(),
-		Hostname:    MustGetHostname(),
-		Typedefs:    make([]*TypedefDecl, 0),
-		ArrayTypes:  make([]*ArrayDecl, 0),
-		MapTypes:    make([]*MapDecl, 0),
-		StructTypes: make([]*StructDecl, 0),
-		Interfaces:  make([]*InterfaceDecl, 0),
-		Constants:   make([]*ConstDecl, 0),
-		Enums:       make([]*Enum, 0),
+		RidlVersion:     strings.TrimSpace(versionNumber),
+		Package:         pkg,
+		Directory:       directory,
+		Filenames:       filenames,
+		BuildTime:       time.Now(),
+		Username:        MustGetUsername(),
+		Hostname:        MustGetHostname(),
+		ABI:             TargetABI,
+		Typedefs:        make([]*TypedefDecl, 0),
+		ArrayTypes:      make([]*ArrayDecl, 0),
+		MapTypes:        make([]*MapDecl, 0),
+		StructTypes:     make([]*StructDecl, 0),
+		Interfaces:      make([]*InterfaceDecl, 0),
+		Constants:       make([]*ConstDecl, 0),
+		Enums:           make([]*Enum, 0),
+		Values:          make([]*ValueDecl, 0),
+		DependencyOrder: pkg.order,
+		Cycles:          pkg.cycles,
 	}
 	for _, decl := range pkg.Decls {
 		switch d := decl.(type) {
@@ -88,18 +105,21 @@ func NewContext(directory string, filenames []string, pkg *Package) *Context {
 			context.StructTypes = append(context.StructTypes, d)
 		case *InterfaceDecl:
 			context.Interfaces = append(context.Interfaces, d)
+		case *ValueDecl:
+			context.Values = append(context.Values, d)
 		default:
 			panic(fmt.Sprintf("unexpected Decl type: %T", d))
 		}
 	}
 	context.findEnums()
+	context.findMessages()
 	return context
 }
 
 func (c *Context) findEnums() {
 	typedefs := make(map[string]*TypedefDecl, len(c.Typedefs))
 	for _, t := range c.Typedefs {
-		if (t.typedef.Info() & types.IsInteger) != 0 {
+		if (t.typedef.Info() & (types.IsInteger | types.IsString)) != 0 {
 			typedefs[t.Name()] = t
 		}
 	}
@@ -115,9 +135,14 @@ func (c *Context) findEnums() {
 			c.NotEnums = append(c.NotEnums, constant)
 		}
 	}
-	for typedef, constants := range m {
-		e := &Enum{typedef, constants, enumIsDense(constants)}
-		c.Enums = append(c.Enums, e)
+	// Enums are ordered as their types are declared.
+	for _, typedef := range c.Typedefs {
+		if constants, found := m[typedef]; found {
+			isString := (typedef.typedef.Info() & types.IsString) != 0
+			e := &Enum{typedef, constants, !isString && enumIsDense(constants), isString}
+			setShortNames(typedef.Name(), constants)
+			c.Enums = append(c.Enums, e)
+		}
 	}
 }
 
@@ -9,11 +9,14 @@ package main
 
 import (
 	"fmt"
+	"go/ast"
 	"go/constant"
 	"go/token"
 	"go/types"
 	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type DeclKind int
@@ -28,6 +31,7 @@ const (
 	DeclKindInterface
 	DeclKindMethod
 	DeclKindMethodArg
+	DeclKindValue
 )
 
 func (d DeclKind) String() string {
@@ -50,6 +54,8 @@ func (d DeclKind) String() string {
 		return "method"
 	case DeclKindMethodArg:
 		return "argument"
+	case DeclKindValue:
+		return "var"
 	}
 	panic(fmt.Errorf("bad DeclKind value == %d", int(d)))
 }
@@ -93,7 +99,19 @@ func (d *decl) Name() string {
 }
 
 func (d *decl) TypeName() string {
-	return TrimUntyped(d.Object.Type().String())
+	return TrimUntyped(getTypeName(d.pkg, d.Object.Type()))
+}
+
+// Type returns a TypeRef describing the receiver's type. For type
+// declarations this is the declared type itself.
+func (d *decl) Type() (*TypeRef, error) {
+	return d.pkg.typeRef(d.Object.Type())
+}
+
+// UnderlyingType returns a TypeRef describing the underlying type of
+// the receiver's type, e.g. the int32 of "type A int32".
+func (d *decl) UnderlyingType() (*TypeRef, error) {
+	return d.pkg.typeRef(d.Object.Type().Underlying())
 }
 
 func (d *decl) IsUntyped() bool {
@@ -110,6 +128,118 @@ func (d *decl) Position() token.Position {
 	return d.pkg.Position(d.Object.Pos())
 }
 
+// Doc returns the text of the declaration's doc comment, the comment
+// that immediately precedes it, or an empty string if it has none.
+func (d *decl) Doc() string {
+	return commentText(d.pkg.comments[d.Object.Pos()].doc)
+}
+
+// DocLines returns the lines of the declaration's doc comment.
+func (d *decl) DocLines() []string {
+	if doc := d.Doc(); doc != "" {
+		return strings.Split(doc, "\n")
+	}
+	return nil
+}
+
+// LineComment returns the text of the comment that follows the
+// declaration on the same line, or an empty string if there is none.
+func (d *decl) LineComment() string {
+	return commentText(d.pkg.comments[d.Object.Pos()].line)
+}
+
+// IsAlias returns true if the declaration is a type alias, declared
+// using the form "type A = B".
+func (d *decl) IsAlias() bool {
+	tn, ok := d.Object.(*types.TypeName)
+	return ok && tn.IsAlias()
+}
+
+// DerivedFrom returns the declaration of the named type a type
+// declaration is derived from, the B in "type A B" or "type A = B",
+// or nil if the type is not derived from a declared type.
+func (d *decl) DerivedFrom() Decl {
+	switch t := d.pkg.derivations[d.Object].(type) {
+	case *types.Named:
+		return d.pkg.Lookup(t.Obj())
+	case *types.Alias:
+		return d.pkg.Lookup(t.Obj())
+	}
+	return nil
+}
+
+// DerivedTypeName returns the name of the type a type declaration is
+// derived from, qualified if it is declared in another package, or
+// an empty string if the type is not derived from a named type.
+func (d *decl) DerivedTypeName() string {
+	switch t := d.pkg.derivations[d.Object].(type) {
+	case *types.Named, *types.Alias:
+		return getTypeName(d.pkg, t)
+	}
+	return ""
+}
+
+// DerivedType returns a TypeRef describing the named type a type
+// declaration is derived from, or nil if the type is not derived from
+// a named type. It is the TypeRef equivalent of DerivedTypeName.
+func (d *decl) DerivedType() (*TypeRef, error) {
+	switch t := d.pkg.derivations[d.Object].(type) {
+	case *types.Named, *types.Alias:
+		return d.pkg.typeRef(t)
+	}
+	return nil, nil
+}
+
+// TypeParams returns the type parameters of a generic type
+// declaration, or nil if the declaration is not generic.
+func (d *decl) TypeParams() []*TypeParam {
+	named, ok := d.Object.Type().(*types.Named)
+	if !ok || d.kind == DeclKindStructField || d.kind == DeclKindMethodArg {
+		return nil
+	}
+	var params []*TypeParam
+	for i := 0; i < named.TypeParams().Len(); i++ {
+		param := named.TypeParams().At(i)
+		params = append(params, &TypeParam{param.Obj().Name(), getTypeName(d.pkg, param.Constraint())})
+	}
+	return params
+}
+
+// IsGeneric returns true if the declaration declares a generic type.
+func (d *decl) IsGeneric() bool {
+	return len(d.TypeParams()) != 0
+}
+
+// Annotations returns the declaration's "//ridl:" annotations.
+func (d *decl) Annotations() Annotations {
+	return d.pkg.annotations[d.Object.Pos()]
+}
+
+// HasAnnotation returns true if the declaration has the annotation
+// with the given key.
+func (d *decl) HasAnnotation(key string) bool {
+	_, found := d.Annotations()[key]
+	return found
+}
+
+// Annotation returns the value of the declaration's annotation with the
+// given key, or nil if it has no such annotation.
+func (d *decl) Annotation(key string) interface{} {
+	if a, found := d.Annotations()[key]; found {
+		return a.Value
+	}
+	return nil
+}
+
+func (d *decl) object() types.Object {
+	return d.Object
+}
+
+// declObject returns the types.Object declared by a Decl.
+func declObject(d Decl) types.Object {
+	return d.(interface{ object() types.Object }).object()
+}
+
 // IsConst returns true if the declaration is a const
 func (d *decl) IsConst() bool {
 	return d.kind == DeclKindConst
@@ -155,6 +285,11 @@ func (d *decl) IsMethodArg() bool {
 	return d.kind == DeclKindMethodArg
 }
 
+// IsValue returns true if the declaration is a var
+func (d *decl) IsValue() bool {
+	return d.kind == DeclKindValue
+}
+
 //  ================================================================
 
 // The ConstDecl type represents a constant.
@@ -162,11 +297,12 @@ type ConstDecl struct {
 	decl
 	IsEnumerator bool
 	EnumType     Decl
+	shortName    string
 }
 
 // NewConstDecl returns a new ConstDecl with the given name, type and value.
 func NewConstDecl(pkg *Package, obj types.Object) *ConstDecl {
-	return &ConstDecl{decl{pkg, obj, DeclKindConst}, false, nil}
+	return &ConstDecl{decl{pkg, obj, DeclKindConst}, false, nil, ""}
 }
 
 func (decl *ConstDecl) Value() constant.Value {
@@ -177,6 +313,134 @@ func (decl *ConstDecl) ExactValue() string {
 	return decl.Object.(*types.Const).Val().ExactString()
 }
 
+// ShortName returns an enumerator's name without the prefix, or
+// suffix, of whole words shared by all of its type's enumerators, e.g.
+// Red for ColorRed or RedComponent. The name of an enum's only
+// enumerator is stripped of its type's name. Other constants, and
+// enumerators with no such prefix or suffix, are returned unchanged.
+func (decl *ConstDecl) ShortName() string {
+	if decl.shortName != "" {
+		return decl.shortName
+	}
+	return decl.Name()
+}
+
+// setShortNames sets the short names of an enum's enumerators, see
+// ShortName.
+func setShortNames(typeName string, enumerators []*ConstDecl) {
+	names := make([]string, len(enumerators))
+	for i, enumerator := range enumerators {
+		names[i] = enumerator.Name()
+	}
+	trim := func(name string) string { return name }
+	switch {
+	case len(names) == 1:
+		trim = func(name string) string {
+			if short := strings.TrimPrefix(name, typeName); isWordStart(short) {
+				return short
+			}
+			if short := strings.TrimSuffix(name, typeName); short != name && short != "" {
+				return short
+			}
+			return name
+		}
+	case commonPrefix(names) != "":
+		prefix := commonPrefix(names)
+		trim = func(name string) string { return strings.TrimPrefix(name, prefix) }
+	case commonSuffix(names) != "":
+		suffix := commonSuffix(names)
+		trim = func(name string) string { return strings.TrimSuffix(name, suffix) }
+	}
+	for i, enumerator := range enumerators {
+		enumerator.shortName = trim(names[i])
+	}
+}
+
+// commonPrefix returns the longest prefix of whole words shared by the
+// given names that leaves every name a word, or "" if there is none.
+func commonPrefix(names []string) string {
+	n := len(names[0])
+	for _, name := range names[1:] {
+		n = min(n, len(name))
+		for i := 0; i < n; i++ {
+			if name[i] != names[0][i] {
+				n = i
+				break
+			}
+		}
+	}
+	for ; n > 0; n-- {
+		ok := true
+		for _, name := range names {
+			if !isWordStart(name[n:]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return names[0][:n]
+		}
+	}
+	return ""
+}
+
+// commonSuffix returns the longest suffix of whole words shared by the
+// given names, leaving none of them empty, or "" if there is none.
+func commonSuffix(names []string) string {
+	n := len(names[0])
+	for _, name := range names[1:] {
+		n = min(n, len(name))
+		for i := 1; i <= n; i++ {
+			if name[len(name)-i] != names[0][len(names[0])-i] {
+				n = i - 1
+				break
+			}
+		}
+	}
+	for ; n > 0; n-- {
+		ok := isWordStart(names[0][len(names[0])-n:])
+		for _, name := range names {
+			if len(name) == n {
+				ok = false
+			}
+		}
+		if ok {
+			return names[0][len(names[0])-n:]
+		}
+	}
+	return ""
+}
+
+// isWordStart returns true if s starts with an upper case letter, the
+// start of a word in a mixed case name.
+func isWordStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsUpper(r)
+}
+
+// isShift returns true if the constant's value is given by a shift
+// expression, e.g. 1 << iota, explicitly or by repetition of the
+// previous expression in a constant declaration group.
+func (decl *ConstDecl) isShift() bool {
+	return decl.pkg.shifts[decl.Object]
+}
+
+// int64Value returns the value of an integer constant.
+func (decl *ConstDecl) int64Value() int64 {
+	n, _ := constant.Int64Val(constant.ToInt(decl.Value()))
+	return n
+}
+
+// uint64Value returns the value of an integer constant as a uint64,
+// negative values as their two's complement.
+func (decl *ConstDecl) uint64Value() uint64 {
+	value := constant.ToInt(decl.Value())
+	if n, exact := constant.Uint64Val(value); exact {
+		return n
+	}
+	return uint64(decl.int64Value())
+}
+
 //  ================================================================
 
 // A TypedefDecl records a type alias formed by a type declaration
@@ -209,15 +473,37 @@ func (decl *TypedefDecl) TypeName() string {
 // being interpreted as an unbounded array).
 type ArrayDecl struct {
 	decl
-	elTypename string
-	elType     types.Type
+	elType types.Type
 }
 
 // NewArrayDecl returns a new ArrayDecl with the supplied name,
 // element type and size. A size of 0 implies an unbounded
 // array, or vector, type.
-func NewArrayDecl(pkg *Package, obj types.Object, typename string, elType types.Type) *ArrayDecl {
-	return &ArrayDecl{decl{pkg, obj, DeclKindArray}, typename, elType}
+func NewArrayDecl(pkg *Package, obj types.Object, elType types.Type) *ArrayDecl {
+	return &ArrayDecl{decl{pkg, obj, DeclKindArray}, elType}
+}
+
+// LengthExpr returns the receiver's length as written in the source,
+// e.g. "MaxName" for [MaxName]byte. It returns an empty string for
+// slices.
+func (a *ArrayDecl) LengthExpr() string {
+	if t, ok := a.Object.Type().Underlying().(*types.Array); ok {
+		return a.pkg.arrayLength(t)
+	}
+	return ""
+}
+
+// LengthConst returns the declaration of the constant that the
+// receiver's length refers to, or nil if its length is not given by
+// a named constant.
+func (a *ArrayDecl) LengthConst() *ConstDecl {
+	if t, ok := a.Object.Type().Underlying().(*types.Array); ok {
+		if length, found := a.pkg.arrayLengths[t]; found && length.obj != nil {
+			decl, _ := a.pkg.Lookup(length.obj).(*ConstDecl)
+			return decl
+		}
+	}
+	return nil
 }
 
 // Length returns the number of elements in the receiver.
@@ -231,9 +517,25 @@ func (a *ArrayDecl) Length() int {
 	panic(fmt.Errorf("unexpected underlying type %T", a.Object.Type().Underlying()))
 }
 
+// ElemType returns a TypeRef describing the type of the elements of
+// the array.
+func (a *ArrayDecl) ElemType() (*TypeRef, error) {
+	ref, err := a.pkg.typeRef(a.Object.Type().Underlying())
+	if err != nil {
+		return nil, err
+	}
+	return ref.Elem, nil
+}
+
 // ElTypeName returns the type of the elements of the array.
 func (a *ArrayDecl) ElTypeName() string {
-	return a.elTypename
+	switch t := a.Object.Type().Underlying().(type) {
+	case *types.Array:
+		return getTypeName(a.pkg, t.Elem())
+	case *types.Slice:
+		return getTypeName(a.pkg, t.Elem())
+	}
+	panic(fmt.Errorf("unexpected underlying type %T", a.Object.Type().Underlying()))
 }
 
 // TypeName returns the name of the receiver's type.
@@ -254,15 +556,24 @@ func (a *ArrayDecl) IsFixedLength() bool {
 // The StructDecl type represents a struct type declaration. A struct
 // type has a name and zero or more fields, represented by StructField
 // values.
+//
+// Fields holds the fields as declared, embedded fields included. The
+// AllFields method returns the flattened view with the fields of any
+// embedded structs promoted into the receiver.
+//
+// IsSynthesized is set for structs that ridl declares for anonymous
+// struct types, e.g. Image_Meta for the type of the field Meta
+// declared as struct { Key, Value string } within Image.
 type StructDecl struct {
 	decl
-	Fields []*StructField
+	Fields        []*StructField
+	IsSynthesized bool
 }
 
 // NewStructDecl returns a new, empty, StructDecl with the
 // given name.
 func NewStructDecl(pkg *Package, obj types.Object) *StructDecl {
-	return &StructDecl{decl{pkg, obj, DeclKindStruct}, nil}
+	return &StructDecl{decl{pkg, obj, DeclKindStruct}, nil, false}
 }
 
 // AddField appends a field to the receiver's collection of fields.
@@ -275,27 +586,169 @@ func (decl *StructDecl) TypeName() string {
 	return decl.Name()
 }
 
+// EmbeddedFields returns the receiver's embedded fields in declaration order.
+func (decl *StructDecl) EmbeddedFields() []*StructField {
+	var embedded []*StructField
+	for _, f := range decl.Fields {
+		if f.IsEmbedded {
+			embedded = append(embedded, f)
+		}
+	}
+	return embedded
+}
+
+// OwnFields returns the receiver's fields that are not embedded.
+func (decl *StructDecl) OwnFields() []*StructField {
+	var own []*StructField
+	for _, f := range decl.Fields {
+		if !f.IsEmbedded {
+			own = append(own, f)
+		}
+	}
+	return own
+}
+
+// AllFields returns the receiver's fields with every embedded struct
+// replaced by its own, recursively flattened, fields. Fields are
+// returned in memory order. Embedded fields whose type is not a
+// struct declared in the package are returned as-is.
+func (decl *StructDecl) AllFields() []*FlatField {
+	return decl.flatten(nil, 0)
+}
+
+// IsFixedLayout returns true if the receiver's fields are all of
+// fixed-layout types, sized numbers, booleans, fixed-length arrays and
+// structs of such types, whose C++ representation has the same size as
+// the struct's Go layout. The platform-sized int, uint and uintptr are
+// not fixed-layout as their Go and mapped C++ sizes differ.
+func (decl *StructDecl) IsFixedLayout() bool {
+	return isFixedLayout(decl.Object.Type())
+}
+
+// hasLayout returns true if the size and alignment of t are known,
+// i.e. they do not depend on type parameters.
+func hasLayout(t types.Type) bool {
+	switch t := types.Unalias(t).(type) {
+	case *types.TypeParam:
+		return false
+	case *types.Named:
+		return hasLayout(t.Underlying())
+	case *types.Array:
+		return hasLayout(t.Elem())
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if !hasLayout(t.Field(i).Type()) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isFixedLayout(t types.Type) bool {
+	switch t := types.Unalias(t).Underlying().(type) {
+	case *types.Basic:
+		switch t.Kind() {
+		case types.Int, types.Uint, types.Uintptr:
+			return false
+		}
+		return t.Info()&(types.IsInteger|types.IsFloat|types.IsBoolean) != 0 && t.Info()&types.IsUntyped == 0
+	case *types.Array:
+		return isFixedLayout(t.Elem())
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if !isFixedLayout(t.Field(i).Type()) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (decl *StructDecl) flatten(path []*StructField, base int) []*FlatField {
+	var fields []*FlatField
+	for _, f := range decl.Fields {
+		if embedded := f.Embedded(); embedded != nil {
+			fields = append(fields, embedded.flatten(append(path[:len(path):len(path)], f), base+f.Offset())...)
+			continue
+		}
+		fields = append(fields, &FlatField{f, decl, path, base + f.Offset()})
+	}
+	return fields
+}
+
+//  ================================================================
+
+// A FlatField is an element of the flattened field list returned by
+// StructDecl.AllFields. Promoted fields record the struct that
+// declares them and the embedded fields through which they were
+// promoted.
+type FlatField struct {
+	*StructField
+	// Origin is the struct that declares the field.
+	Origin *StructDecl
+	// Path holds the embedded fields, outermost first, through
+	// which the field is promoted. Path is empty for a struct's
+	// own fields.
+	Path   []*StructField
+	offset int
+}
+
+// Offset returns the offset of the field within the outermost struct.
+func (f *FlatField) Offset() int {
+	return f.offset
+}
+
+// IsPromoted returns true if the field is promoted from an embedded struct.
+func (f *FlatField) IsPromoted() bool {
+	return len(f.Path) > 0
+}
+
 //  ================================================================
 
 // The StructField type represents a field within a structure.  Each
-// field has a name and a type. Embedded types are represented by
-// fields with an empty Name.
+// field has a name and a type. Embedded fields have IsEmbedded set
+// and are named after their type, as in Go.
+//
+// Tags holds the field's struct tags. The options of a "ridl" tag,
+// if present, are parsed into the TagName, Optional, Default,
+// HasDefault and Since fields (see parseRidlTag).
 type StructField struct {
 	decl
-	Tags      []Tag
-	offset    int
-	alignment int
+	Tags       []Tag
+	IsEmbedded bool
+	TagName    string
+	Optional   bool
+	Default    string
+	HasDefault bool
+	Since      int
+	offset     int
+	alignment  int
 }
 
 // NewStructField returns a new StructField
 func NewStructField(pkg *Package, obj types.Object, offset, alignment int64) *StructField {
-	return &StructField{decl{pkg, obj, DeclKindStructField}, nil, int(offset), int(alignment)}
+	return &StructField{
+		decl:      decl{pkg, obj, DeclKindStructField},
+		offset:    int(offset),
+		alignment: int(alignment),
+	}
 }
 
 func (sf *StructField) Name() string {
 	return sf.Object.Name()
 }
 
+// WireName returns the field's name as set by a ridl tag's name
+// option, or its Go name if there is no such option.
+func (sf *StructField) WireName() string {
+	if sf.TagName != "" {
+		return sf.TagName
+	}
+	return sf.Name()
+}
+
 func (sf *StructField) Offset() int {
 	return sf.offset
 }
@@ -304,6 +757,28 @@ func (sf *StructField) Alignment() int {
 	return sf.alignment
 }
 
+// IsOptional returns true if the field's type is a pointer, Go's
+// representation of an optional value. A field whose ridl tag has the
+// optional option, which may be omitted on the wire, has Optional set.
+func (sf *StructField) IsOptional() bool {
+	return isOptionalType(sf.Object.Type())
+}
+
+// Embedded returns the StructDecl of an embedded field's type. It
+// returns nil if the field is not embedded or its type is not a
+// struct declared by the package.
+func (sf *StructField) Embedded() *StructDecl {
+	if !sf.IsEmbedded {
+		return nil
+	}
+	named, ok := types.Unalias(sf.Object.Type()).(*types.Named)
+	if !ok {
+		return nil
+	}
+	embedded, _ := sf.pkg.Lookup(named.Obj()).(*StructDecl)
+	return embedded
+}
+
 func (sf *StructField) HasTag(key string) bool {
 	for _, tag := range sf.Tags {
 		if tag.Key == key {
@@ -351,7 +826,7 @@ func (decl *MapDecl) asMap() *types.Map {
 
 // Type returns the type of the receiver's values.
 func (decl *MapDecl) TypeName() string {
-	return decl.asMap().String()
+	return getTypeName(decl.pkg, decl.asMap())
 }
 
 func (decl *MapDecl) Key() types.Type {
@@ -362,20 +837,48 @@ func (decl *MapDecl) Value() types.Type {
 	return decl.valType
 }
 
+// KeyType returns a TypeRef describing the map's key type.
+func (decl *MapDecl) KeyType() (*TypeRef, error) {
+	return decl.pkg.typeRef(decl.keyType)
+}
+
+// ValueType returns a TypeRef describing the map's value type.
+func (decl *MapDecl) ValueType() (*TypeRef, error) {
+	return decl.pkg.typeRef(decl.valType)
+}
+
+// KeyTypeName returns the Go representation of the map's key type.
+func (decl *MapDecl) KeyTypeName() string {
+	return getTypeName(decl.pkg, decl.keyType)
+}
+
+// ValueTypeName returns the Go representation of the map's value type.
+func (decl *MapDecl) ValueTypeName() string {
+	return getTypeName(decl.pkg, decl.valType)
+}
+
 //  ================================================================
 
 // The InterfaceDecl type represents an interface type. An interface
 // is a, named, collection of zero or more Methods.
+//
+// OwnMethods holds the methods declared by the interface itself and
+// Embeds the interfaces it embeds. Methods holds the complete method
+// set, in declaration order, with the methods of embedded interfaces
+// represented by the MethodDecl of their declaring interface.
 type InterfaceDecl struct {
 	decl
-	Methods  []*MethodDecl
-	embedded []*InterfaceDecl
+	Methods    []*MethodDecl
+	OwnMethods []*MethodDecl
+	Embeds     []*InterfaceDecl
+	ID         int
+	resolved   bool
 }
 
 // NewInterfaceDecl returns a new, empty, InterfaceDecl with the
 // given name.
 func NewInterfaceDecl(pkg *Package, obj types.Object) *InterfaceDecl {
-	return &InterfaceDecl{decl{pkg, obj, DeclKindInterface}, nil, nil}
+	return &InterfaceDecl{decl{pkg, obj, DeclKindInterface}, nil, nil, nil, 0, false}
 }
 
 // Type returns the receiver's type.
@@ -385,12 +888,56 @@ func (decl *InterfaceDecl) TypeName() string {
 
 // Declare appends a method declaration to the interface.
 func (decl *InterfaceDecl) addMethod(method *MethodDecl) {
-	decl.Methods = append(decl.Methods, method)
+	method.Interface = decl
+	decl.OwnMethods = append(decl.OwnMethods, method)
 }
 
 // Embed appends an embedded interface to the interface.
 func (decl *InterfaceDecl) Embed(intf *InterfaceDecl) {
-	decl.embedded = append(decl.embedded, intf)
+	decl.Embeds = append(decl.Embeds, intf)
+}
+
+// AllMethods returns the receiver's complete method set. Each
+// method's Interface identifies the interface that declares it.
+func (decl *InterfaceDecl) AllMethods() []*MethodDecl {
+	return decl.Methods
+}
+
+// resolve links the receiver to the interfaces it embeds and builds
+// its complete method set. Embedded interfaces are resolved first so
+// their methods are shared rather than duplicated. Methods promoted
+// from interfaces not declared by the package are given a MethodDecl
+// with a nil Interface.
+func (decl *InterfaceDecl) resolve() {
+	if decl.resolved {
+		return
+	}
+	decl.resolved = true
+	interfaceType := decl.Object.Type().Underlying().(*types.Interface)
+	declared := make(map[types.Object]*MethodDecl)
+	for _, method := range decl.OwnMethods {
+		declared[method.Object] = method
+	}
+	for i := 0; i < interfaceType.NumEmbeddeds(); i++ {
+		named, ok := types.Unalias(interfaceType.EmbeddedType(i)).(*types.Named)
+		if !ok {
+			continue
+		}
+		if embedded, ok := decl.pkg.Lookup(named.Obj()).(*InterfaceDecl); ok {
+			embedded.resolve()
+			decl.Embed(embedded)
+			for _, method := range embedded.Methods {
+				declared[method.Object] = method
+			}
+		}
+	}
+	for _, method := range methodsInOrder(interfaceType.NumMethods(), interfaceType.Method) {
+		m, found := declared[method]
+		if !found {
+			m = makeMethod(decl.pkg, method)
+		}
+		decl.Methods = append(decl.Methods, m)
+	}
 }
 
 //  ================================================================
@@ -398,16 +945,25 @@ func (decl *InterfaceDecl) Embed(intf *InterfaceDecl) {
 // The MethodDecl type represents a method declared within an interface.
 // A method has a name, zero or more arguments and zero or more results.
 // Both arguments and results are represented by MethodArg values.
+//
+// Interface is the interface that declares the method. It is nil for
+// methods promoted from interfaces declared outside the package.
+// Request and Response are the method's messages, see Message, and
+// ID its stable ID, see assignIDs. Oneway methods have no Response.
 type MethodDecl struct {
 	decl
-	Args    []*MethodArg
-	Results []*MethodArg
+	Args      []*MethodArg
+	Results   []*MethodArg
+	Interface *InterfaceDecl
+	Request   *Message
+	Response  *Message
+	ID        int
 }
 
 // NewMethod returns a new Method with the given name, arguments
 // and results.
 func NewMethod(pkg *Package, obj types.Object, args []*MethodArg, results []*MethodArg) *MethodDecl {
-	return &MethodDecl{decl{pkg, obj, DeclKindMethod}, args, results}
+	return &MethodDecl{decl{pkg, obj, DeclKindMethod}, args, results, nil, nil, nil, 0}
 }
 
 // Type returns the receiver's type.
@@ -415,6 +971,31 @@ func (decl *MethodDecl) TypeName() string {
 	return decl.Name()
 }
 
+// HasError returns true if the method's last result is an error.
+func (decl *MethodDecl) HasError() bool {
+	return decl.ErrorResult() != nil
+}
+
+// ErrorResult returns the method's last result if it is an error,
+// otherwise nil.
+func (decl *MethodDecl) ErrorResult() *MethodArg {
+	if n := len(decl.Results); n != 0 {
+		if last := decl.Results[n-1]; types.Identical(last.Object.Type(), types.Universe.Lookup("error").Type()) {
+			return last
+		}
+	}
+	return nil
+}
+
+// ValueResults returns the method's results other than its error
+// result.
+func (decl *MethodDecl) ValueResults() []*MethodArg {
+	if decl.HasError() {
+		return decl.Results[:len(decl.Results)-1]
+	}
+	return decl.Results
+}
+
 //  ================================================================
 
 // The MethodArg  type represents an  argument to  or a result  from a
@@ -431,22 +1012,141 @@ func NewMethodArg(pkg *Package, obj types.Object, name string) *MethodArg {
 
 // Type returns the receiver's type.
 func (decl *MethodArg) TypeName() string {
-	return decl.Object.Type().String()
+	return getTypeName(decl.pkg, decl.Object.Type())
 }
 
 func (decl *MethodArg) Name() string {
 	return decl.name
 }
 
+// IsOptional returns true if the argument's type is a pointer, Go's
+// representation of an optional value.
+func (decl *MethodArg) IsOptional() bool {
+	return isOptionalType(decl.Object.Type())
+}
+
+//  ================================================================
+
+// A TypeParam is a type parameter of a generic type declaration.
+type TypeParam struct {
+	Name       string
+	Constraint string
+}
+
+// An Instance records an instantiation of a generic type, e.g.
+// Page[Image], used by the package's declarations.
+type Instance struct {
+	// Generic is the declaration of the generic type, nil if it
+	// is not declared by the package or one it imports.
+	Generic Decl
+	// TypeArgs holds the names of the type arguments.
+	TypeArgs []string
+	// TypeName is the instantiated type's name, e.g. "Page[Image]".
+	TypeName string
+}
+
 //  ================================================================
 
 // Enum represents a C/C++ enumerated type that has been emulated
 // using the Go idiom of defining a type and a series of constants of
-// that type.
+// that type. Enumerators are in declaration order.
+//
+// The type of an enum is an integer or, if IsString is set, a string
+// type. Min, Max, IsFlags and Mask are only meaningful for integer
+// enums.
 type Enum struct {
 	Type        *TypedefDecl
 	Enumerators []*ConstDecl
 	IsDense     bool
+	IsString    bool
+}
+
+// Count returns the number of enumerators.
+func (e *Enum) Count() int {
+	return len(e.Enumerators)
+}
+
+// Min returns the smallest enumerator value of an integer enum.
+func (e *Enum) Min() int64 {
+	min, _ := e.bounds()
+	return min
+}
+
+// Max returns the largest enumerator value of an integer enum.
+func (e *Enum) Max() int64 {
+	_, max := e.bounds()
+	return max
+}
+
+func (e *Enum) bounds() (min, max int64) {
+	if e.IsString {
+		return 0, 0
+	}
+	for i, enumerator := range e.Enumerators {
+		n := enumerator.int64Value()
+		if i == 0 || n < min {
+			min = n
+		}
+		if i == 0 || n > max {
+			max = n
+		}
+	}
+	return min, max
+}
+
+// HasDuplicates returns true if two or more enumerators have the
+// same value.
+func (e *Enum) HasDuplicates() bool {
+	seen := make(map[string]bool)
+	for _, enumerator := range e.Enumerators {
+		value := enumerator.ExactValue()
+		if seen[value] {
+			return true
+		}
+		seen[value] = true
+	}
+	return false
+}
+
+// Default returns the first enumerator whose value is the zero value,
+// 0 or "", the value of an uninitialized variable of the enum type, or
+// nil if there is no such enumerator.
+func (e *Enum) Default() *ConstDecl {
+	for _, enumerator := range e.Enumerators {
+		value := enumerator.Value()
+		if value.Kind() == constant.String && constant.StringVal(value) == "" ||
+			value.Kind() == constant.Int && constant.Sign(value) == 0 {
+			return enumerator
+		}
+	}
+	return nil
+}
+
+// IsFlags returns true if the enum's values are bit flags, i.e. its
+// enumerators are declared using shifts, as in 1 << iota. Other
+// enumerators may name no flags or combinations of flags, e.g. PermAll
+// = PermRead | PermWrite.
+func (e *Enum) IsFlags() bool {
+	if e.IsString {
+		return false
+	}
+	for _, enumerator := range e.Enumerators {
+		if enumerator.isShift() {
+			return true
+		}
+	}
+	return false
+}
+
+// Mask returns the bitwise or of the enumerator values.
+func (e *Enum) Mask() uint64 {
+	var mask uint64
+	if !e.IsString {
+		for _, enumerator := range e.Enumerators {
+			mask |= enumerator.uint64Value()
+		}
+	}
+	return mask
 }
 
 //  ================================================================
@@ -454,7 +1154,7 @@ type Enum struct {
 func makeDecl(pkg *Package, obj *types.TypeName) Decl {
 	switch t := obj.Type().Underlying().(type) {
 	case *types.Array:
-		return NewArrayDecl(pkg, obj, getTypeName(t.Elem()), t.Elem().Underlying())
+		return NewArrayDecl(pkg, obj, t.Elem().Underlying())
 	case *types.Basic:
 		return NewTypedefDecl(pkg, obj, t)
 	case *types.Interface:
@@ -462,7 +1162,7 @@ func makeDecl(pkg *Package, obj *types.TypeName) Decl {
 	case *types.Struct:
 		return makeStruct(pkg, obj, t)
 	case *types.Slice:
-		return NewArrayDecl(pkg, obj, getTypeName(t.Elem()), t.Elem().Underlying())
+		return NewArrayDecl(pkg, obj, t.Elem().Underlying())
 	case *types.Map:
 		return NewMapDecl(pkg, obj, t.Key(), t.Elem())
 	default:
@@ -470,15 +1170,20 @@ func makeDecl(pkg *Package, obj *types.TypeName) Decl {
 	}
 }
 
-func getTypeName(t types.Type) string {
-	switch actual := t.(type) {
-	case *types.Basic:
-		return actual.Name()
-	case *types.Named:
-		return actual.Obj().Name()
-	default:
-		panic(fmt.Errorf("getTypeName: %T", t))
-	}
+// getTypeName returns the Go representation of a type. The names of
+// types declared in other packages are qualified by their package
+// name, those declared in pkg are not. Anonymous struct types are
+// named by the structs synthesized for them and array lengths are
+// given as written, e.g. [MaxName]byte.
+func getTypeName(pkg *Package, t types.Type) string {
+	return pkg.typeString(t)
+}
+
+// isOptionalType returns true if t represents an optional value. ridl
+// interprets a pointer type, *T, as an optional T.
+func isOptionalType(t types.Type) bool {
+	_, isPointer := t.(*types.Pointer)
+	return isPointer
 }
 
 func makeStruct(pkg *Package, obj types.Object, structType *types.Struct) Decl {
@@ -487,15 +1192,23 @@ func makeStruct(pkg *Package, obj types.Object, structType *types.Struct) Decl {
 	for i := 0; i < structType.NumFields(); i++ {
 		fields[i] = structType.Field(i)
 	}
-	offsets := Sizer.Offsetsof(fields)
+	// The layout of a generic struct depends on its type arguments.
+	offsets := make([]int64, len(fields))
+	if hasLayout(structType) {
+		offsets = Sizer.Offsetsof(fields)
+	}
 	for i := 0; i < structType.NumFields(); i++ {
 		field := fields[i]
-		if field.Anonymous() {
-			// TODO: allow embedding
-			continue
-		}
 		fieldType := field.Type()
-		f := NewStructField(pkg, field, offsets[i], Sizer.Alignof(fieldType)) // XXX check pos
+		var align int64
+		if hasLayout(fieldType) {
+			align = Sizer.Alignof(fieldType)
+		}
+		f := NewStructField(pkg, field, offsets[i], align) // XXX check pos
+		f.IsEmbedded = field.Anonymous()
+		if err := f.setTags(structType.Tag(i)); err != nil {
+			pkg.errorf(field.Pos(), "field %s.%s: %v", obj.Name(), field.Name(), err)
+		}
 		decl.AddField(f)
 	}
 	return decl
@@ -503,23 +1216,30 @@ func makeStruct(pkg *Package, obj types.Object, structType *types.Struct) Decl {
 
 func makeInterface(pkg *Package, obj types.Object, interfaceType *types.Interface) Decl {
 	intf := NewInterfaceDecl(pkg, obj)
-	methodsInOrder := make([]*types.Func, interfaceType.NumMethods())
-	for i := 0; i < interfaceType.NumMethods(); i++ {
-		methodsInOrder[i] = interfaceType.Method(i)
-	}
-	sort.Slice(methodsInOrder, func(i, j int) bool {
-		return methodsInOrder[i].Pos() < methodsInOrder[j].Pos()
-	})
-	for i := 0; i < interfaceType.NumMethods(); i++ {
-		method := methodsInOrder[i]
-		signature := method.Type().(*types.Signature)
-		args := makeArgs(pkg, method, signature.Params(), "arg")
-		results := makeArgs(pkg, method, signature.Results(), "res")
-		intf.addMethod(NewMethod(pkg, method, args, results))
+	for _, method := range methodsInOrder(interfaceType.NumExplicitMethods(), interfaceType.ExplicitMethod) {
+		intf.addMethod(makeMethod(pkg, method))
 	}
 	return intf
 }
 
+func methodsInOrder(n int, method func(int) *types.Func) []*types.Func {
+	methods := make([]*types.Func, n)
+	for i := 0; i < n; i++ {
+		methods[i] = method(i)
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		return methods[i].Pos() < methods[j].Pos()
+	})
+	return methods
+}
+
+func makeMethod(pkg *Package, method *types.Func) *MethodDecl {
+	signature := method.Type().(*types.Signature)
+	args := makeArgs(pkg, method, signature.Params(), "arg")
+	results := makeArgs(pkg, method, signature.Results(), "res")
+	return NewMethod(pkg, method, args, results)
+}
+
 func makeArgs(pkg *Package, obj types.Object, args *types.Tuple, prefix string) []*MethodArg {
 	methodArgs := make([]*MethodArg, 0)
 	for i := 0; i < args.Len(); i++ {
@@ -532,3 +1252,98 @@ func makeArgs(pkg *Package, obj types.Object, args *types.Tuple, prefix string)
 	}
 	return methodArgs
 }
+
+// An arrayLength is the length of an array type as written in the
+// source and the constant, if any, it refers to.
+type arrayLength struct {
+	expr string
+	obj  types.Object
+}
+
+// collectArrayLengths returns the lengths, as written, of the array
+// types in the given files indexed by their types. Lengths that are
+// literals are not recorded.
+func collectArrayLengths(files []*ast.File, info *types.Info) map[*types.Array]arrayLength {
+	lengths := make(map[*types.Array]arrayLength)
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			expr, ok := n.(*ast.ArrayType)
+			if !ok || expr.Len == nil {
+				return true
+			}
+			t, ok := info.TypeOf(expr).(*types.Array)
+			if _, isLiteral := expr.Len.(*ast.BasicLit); !ok || isLiteral {
+				return true
+			}
+			length := arrayLength{expr: types.ExprString(expr.Len)}
+			switch e := expr.Len.(type) {
+			case *ast.Ident:
+				length.obj = info.Uses[e]
+			case *ast.SelectorExpr:
+				length.obj = info.Uses[e.Sel]
+			}
+			if _, isConst := length.obj.(*types.Const); !isConst {
+				length.obj = nil
+			}
+			lengths[t] = length
+			return true
+		})
+	}
+	return lengths
+}
+
+// collectDerivations returns the types referenced by the type
+// declarations in the given files, the right hand side of each
+// "type A B" or "type A = B", indexed by the declared type's object.
+func collectDerivations(files []*ast.File, info *types.Info) map[types.Object]types.Type {
+	derivations := make(map[types.Object]types.Type)
+	for _, file := range files {
+		for _, d := range file.Decls {
+			gen, ok := d.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.TypeSpec)
+				if obj := info.Defs[spec.Name]; obj != nil {
+					derivations[obj] = info.TypeOf(spec.Type)
+				}
+			}
+		}
+	}
+	return derivations
+}
+
+// collectShifts returns the constants in the given files whose values
+// are given by left shift expressions, such as 1 << iota. Constants
+// without an explicit value repeat the previous expression of their
+// declaration group.
+func collectShifts(files []*ast.File, info *types.Info) map[types.Object]bool {
+	shifts := make(map[types.Object]bool)
+	for _, file := range files {
+		for _, d := range file.Decls {
+			gen, ok := d.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			var values []ast.Expr
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.ValueSpec)
+				if len(spec.Values) != 0 {
+					values = spec.Values
+				}
+				for i, name := range spec.Names {
+					if i >= len(values) {
+						break
+					}
+					if expr, ok := ast.Unparen(values[i]).(*ast.BinaryExpr); ok && expr.Op == token.SHL {
+						if obj := info.Defs[name]; obj != nil {
+							shifts[obj] = true
+						}
+					}
+				}
+			}
+		}
+	}
+	return shifts
+}
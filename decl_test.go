@@ -0,0 +1,1412 @@
+package main
+
+import (
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkFiles loads the package made up of the named files as ridl
+// does, using a new importer.
+func checkFiles(filenames []string) (*Package, error) {
+	return newRidlImporter(token.NewFileSet(), importSearchPath()).check("", filenames)
+}
+
+// writeSources writes the given sources, indexed by slash-separated
+// paths relative to root, creating directories as required.
+func writeSources(t *testing.T, root string, sources map[string]string) {
+	t.Helper()
+	for name, source := range sources {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkSource loads the package made up of a single file holding the
+// given source.
+func checkSource(t *testing.T, source string) (*Package, error) {
+	t.Helper()
+	dir := t.TempDir()
+	writeSources(t, dir, map[string]string{"test.ridl": source})
+	return checkFiles([]string{filepath.Join(dir, "test.ridl")})
+}
+
+func parseSource(t *testing.T, source string) *Package {
+	t.Helper()
+	pkg, err := checkSource(t, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func findDecl(t *testing.T, pkg *Package, name string) Decl {
+	t.Helper()
+	for _, decl := range pkg.Decls {
+		if decl.Name() == name {
+			return decl
+		}
+	}
+	t.Fatalf("%q: not declared", name)
+	return nil
+}
+
+func TestStructEmbedding(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Header struct {
+	Code uint16
+	Size uint16
+}
+
+type Message struct {
+	Header
+	Payload [32]float32
+}
+`)
+	message := findDecl(t, pkg, "Message").(*StructDecl)
+	if len(message.Fields) != 2 {
+		t.Fatalf("Message has %d fields, expected 2", len(message.Fields))
+	}
+	header := message.Fields[0]
+	if !header.IsEmbedded || header.Name() != "Header" {
+		t.Fatalf("Message.%s: expected embedded Header field", header.Name())
+	}
+	if header.Embedded() != findDecl(t, pkg, "Header") {
+		t.Fatalf("Message.Header not linked to the Header StructDecl")
+	}
+
+	all := message.AllFields()
+	expected := []struct {
+		name     string
+		offset   int
+		promoted bool
+	}{
+		{"Code", 0, true},
+		{"Size", 2, true},
+		{"Payload", 4, false},
+	}
+	if len(all) != len(expected) {
+		t.Fatalf("AllFields returned %d fields, expected %d", len(all), len(expected))
+	}
+	for i, e := range expected {
+		f := all[i]
+		if f.Name() != e.name || f.Offset() != e.offset || f.IsPromoted() != e.promoted {
+			t.Errorf("field %d: got %s @ %d (promoted %v), expected %s @ %d (promoted %v)",
+				i, f.Name(), f.Offset(), f.IsPromoted(), e.name, e.offset, e.promoted)
+		}
+	}
+	if all[0].Origin.Name() != "Header" {
+		t.Errorf("promoted field Code has origin %q, expected Header", all[0].Origin.Name())
+	}
+}
+
+func TestInterfaceEmbedding(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Pinger interface {
+	Ping() error
+}
+
+type Service interface {
+	Pinger
+	Auth
+	Hello(name string) string
+}
+
+type Auth interface {
+	Login(user string) error
+}
+`)
+	pinger := findDecl(t, pkg, "Pinger").(*InterfaceDecl)
+	auth := findDecl(t, pkg, "Auth").(*InterfaceDecl)
+	service := findDecl(t, pkg, "Service").(*InterfaceDecl)
+
+	if len(service.Embeds) != 2 || service.Embeds[0] != pinger || service.Embeds[1] != auth {
+		t.Fatalf("Service embeds %d interfaces, expected Pinger and Auth", len(service.Embeds))
+	}
+	if len(service.OwnMethods) != 1 || service.OwnMethods[0].Name() != "Hello" {
+		t.Fatalf("Service should declare only Hello")
+	}
+	declaredBy := map[string]*InterfaceDecl{
+		"Ping":  pinger,
+		"Login": auth,
+		"Hello": service,
+	}
+	all := service.AllMethods()
+	if len(all) != len(declaredBy) {
+		t.Fatalf("Service has %d methods, expected %d", len(all), len(declaredBy))
+	}
+	for _, method := range all {
+		if method.Interface != declaredBy[method.Name()] {
+			t.Errorf("Service.%s: wrong declaring interface", method.Name())
+		}
+	}
+	if all[0] != pinger.OwnMethods[0] {
+		t.Errorf("Service.Ping is not shared with Pinger.Ping")
+	}
+}
+
+func TestStructTags(t *testing.T) {
+	pkg := parseSource(t, "package test\n\n"+
+		"type Config struct {\n"+
+		"\tRetries int    `json:\"retries\" ridl:\"name=retry_count,optional,default=3,since=2\"`\n"+
+		"\tHost    string `json:\"host,omitempty\"`\n"+
+		"}\n")
+	config := findDecl(t, pkg, "Config").(*StructDecl)
+
+	retries := config.Fields[0]
+	if len(retries.Tags) != 2 || retries.TagValue("json") != "retries" {
+		t.Fatalf("Retries: unexpected tags %v", retries.Tags)
+	}
+	if retries.WireName() != "retry_count" || !retries.Optional ||
+		!retries.HasDefault || retries.Default != "3" || retries.Since != 2 {
+		t.Errorf("Retries: ridl options not parsed: %+v", retries)
+	}
+
+	host := config.Fields[1]
+	if !host.HasTag("json") || host.HasTag(RidlTagKey) || host.WireName() != "Host" {
+		t.Errorf("Host: unexpected tags %v", host.Tags)
+	}
+}
+
+func TestParseTagsMalformed(t *testing.T) {
+	for _, tag := range []string{`json`, `json:retries`, `json:"retries`, `:"x"`} {
+		if _, err := parseTags(tag); err == nil {
+			t.Errorf("parseTags(%q) did not fail", tag)
+		}
+	}
+	sf := &StructField{}
+	if err := sf.parseRidlTag("nullable"); err == nil {
+		t.Errorf("unknown ridl option accepted")
+	}
+}
+
+func TestRidlTagErrors(t *testing.T) {
+	source := "package test\n\n" +
+		"type Config struct {\n" +
+		"\tA int32 `ridl:\"bogus\"`\n" +
+		"\tB int32 `ridl:\"since=x\"`\n" +
+		"}\n"
+	_, err := checkSource(t, source)
+	diagnostics, ok := err.(Diagnostics)
+	if !ok || len(diagnostics) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %v", err)
+	}
+	expected := []string{
+		`field Config.A: ridl tag: unknown option "bogus"`,
+		`field Config.B: ridl tag: since option requires a non-negative integer, not "x"`,
+	}
+	for i, message := range expected {
+		if diagnostics[i].Message != message {
+			t.Errorf("diagnostic #%d is %q, expected %q", i+1, diagnostics[i].Message, message)
+		}
+		if diagnostics[i].Position.Line != 4+i {
+			t.Errorf("diagnostic #%d is at line %d, expected %d", i+1, diagnostics[i].Position.Line, 4+i)
+		}
+	}
+}
+
+func TestOptionalValues(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Timestamp struct {
+	Secs uint64
+}
+
+type Record struct {
+	Time *Timestamp
+	Name string
+	Tag  string `+"`ridl:\"optional\"`"+`
+}
+
+type Service interface {
+	Find(name *string) (*Record, error)
+}
+`)
+	record := findDecl(t, pkg, "Record").(*StructDecl)
+	if !record.Fields[0].IsOptional() || record.Fields[1].IsOptional() || record.Fields[2].IsOptional() {
+		t.Errorf("Record: only Time should be optional")
+	}
+	if record.Fields[0].Optional || !record.Fields[2].Optional {
+		t.Errorf("Record: only Tag should have the optional tag option")
+	}
+	find := findDecl(t, pkg, "Service").(*InterfaceDecl).Methods[0]
+	if !find.Args[0].IsOptional() || !find.Results[0].IsOptional() || find.Results[1].IsOptional() {
+		t.Errorf("Service.Find: wrong optional arguments or results")
+	}
+}
+
+func TestPermissive(t *testing.T) {
+	const source = `package test
+
+type Record struct {
+	Name string
+}
+
+func (r Record) String() string { return r.Name }
+
+type Callback func(Record)
+
+var Default = New()
+
+func New() Record { return Record{"default"} }
+
+type Stream struct {
+	Ch chan Record
+}
+
+type Plain struct {
+	S Stream
+}
+
+type Plains []Plain
+
+type Feed interface {
+	Next() Plain
+}
+`
+	*permissiveFlag = true
+	defer func() { *permissiveFlag = false }()
+	pkg := parseSource(t, source)
+	if len(pkg.Decls) != 1 || pkg.Decls[0].Name() != "Record" {
+		t.Fatalf("expected only Record to be declared, got %d declarations", len(pkg.Decls))
+	}
+	expected := []SkippedDecl{
+		{What: "method Record.String", Reason: "methods are not permitted"},
+		{What: "type Callback", Reason: "function types are not permitted"},
+		{What: "var Default", Reason: "only variables initialized by composite literals are permitted"},
+		{What: "func New", Reason: "functions are not permitted"},
+		{What: "type Stream", Reason: "field Stream.Ch: channel types are not permitted"},
+		{What: "type Plain", Reason: "uses skipped type Stream"},
+		{What: "type Plains", Reason: "uses skipped type Plain"},
+		{What: "type Feed", Reason: "uses skipped type Plain"},
+	}
+	if len(pkg.Skipped) != len(expected) {
+		t.Fatalf("%d declarations skipped, expected %d: %v", len(pkg.Skipped), len(expected), pkg.Skipped)
+	}
+	for i, e := range expected {
+		if s := pkg.Skipped[i]; s.What != e.What || s.Reason != e.Reason {
+			t.Errorf("skipped #%d is %q (%s), expected %q (%s)", i+1, s.What, s.Reason, e.What, e.Reason)
+		}
+	}
+}
+
+func TestNestedTypes(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Item struct {
+	N int
+}
+
+type Grid [][]float32
+
+type Index map[string][]Item
+
+type Quad [4]map[int][2]Item
+`)
+	if name := findDecl(t, pkg, "Grid").(*ArrayDecl).ElTypeName(); name != "[]float32" {
+		t.Errorf("Grid element type is %q", name)
+	}
+	if name := findDecl(t, pkg, "Index").(*MapDecl).ValueTypeName(); name != "[]Item" {
+		t.Errorf("Index value type is %q", name)
+	}
+	if name := findDecl(t, pkg, "Quad").(*ArrayDecl).ElTypeName(); name != "map[int][2]Item" {
+		t.Errorf("Quad element type is %q", name)
+	}
+}
+
+func TestComments(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+// Timestamp is a point in time.
+//
+// It is relative to the Unix epoch.
+type Timestamp struct {
+	// Seconds since the epoch.
+	Secs  uint64
+	Nanos uint32 // [0, 999999999]
+}
+
+type Color int
+
+const (
+	// The color red.
+	Red Color = iota
+	Green // The color green.
+)
+
+// Service is the service.
+type Service interface {
+	// Hello says hello.
+	Hello(
+		name string, // who to greet
+		t Timestamp, // when
+	) error // always nil
+}
+`)
+	check := func(what, got, expected string) {
+		t.Helper()
+		if got != expected {
+			t.Errorf("%s: got %q, expected %q", what, got, expected)
+		}
+	}
+	timestamp := findDecl(t, pkg, "Timestamp").(*StructDecl)
+	check("Timestamp doc", timestamp.Doc(), "Timestamp is a point in time.\n\nIt is relative to the Unix epoch.")
+	check("Timestamp.Secs doc", timestamp.Fields[0].Doc(), "Seconds since the epoch.")
+	check("Timestamp.Nanos line comment", timestamp.Fields[1].LineComment(), "[0, 999999999]")
+	check("Red doc", findDecl(t, pkg, "Red").(*ConstDecl).Doc(), "The color red.")
+	check("Green line comment", findDecl(t, pkg, "Green").(*ConstDecl).LineComment(), "The color green.")
+	check("Color doc", findDecl(t, pkg, "Color").(*TypedefDecl).Doc(), "")
+
+	service := findDecl(t, pkg, "Service").(*InterfaceDecl)
+	check("Service doc", service.Doc(), "Service is the service.")
+	hello := service.Methods[0]
+	check("Hello doc", hello.Doc(), "Hello says hello.")
+	check("Hello name line comment", hello.Args[0].LineComment(), "who to greet")
+	check("Hello t line comment", hello.Args[1].LineComment(), "when")
+	check("Hello line comment", hello.LineComment(), "always nil")
+}
+
+func TestAnnotations(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+//ridl:id 7
+//ridl:deprecated "use ServiceV2"
+type Service interface {
+	// Notify sends a notification.
+	//ridl:id 42
+	//ridl:oneway
+	Notify(message string)
+}
+
+type Config struct {
+	//ridl:deprecated
+	Retries int
+}
+`)
+	service := findDecl(t, pkg, "Service").(*InterfaceDecl)
+	if message := service.Annotation("deprecated"); message != "use ServiceV2" {
+		t.Errorf("Service deprecated annotation is %v", message)
+	}
+	if service.ID != 7 {
+		t.Errorf("Service ID is %d, expected 7", service.ID)
+	}
+	notify := service.Methods[0]
+	if !notify.HasAnnotation("oneway") || notify.Annotation("id") != 42 {
+		t.Errorf("Notify annotations are %v", notify.Annotations())
+	}
+	if notify.Doc() != "Notify sends a notification." {
+		t.Errorf("Notify doc comment is %q", notify.Doc())
+	}
+	retries := findDecl(t, pkg, "Config").(*StructDecl).Fields[0]
+	if retries.Annotation("deprecated") != "" {
+		t.Errorf("Config.Retries annotations are %v", retries.Annotations())
+	}
+}
+
+func TestAnnotationErrors(t *testing.T) {
+	source := `package test
+
+//ridl:oneway
+//ridl:colour blue
+type Config struct {
+	//ridl:since 3
+	Retries int
+}
+
+//ridl:id three
+type Service interface{}
+
+type Events interface {
+	//ridl:oneway
+	Tick() error
+}
+
+//ridl:id 9
+const PackageID = 1
+`
+	_, err := checkSource(t, source)
+	diagnostics, ok := err.(Diagnostics)
+	if !ok || len(diagnostics) != 6 {
+		t.Fatalf("expected 6 diagnostics, got %v", err)
+	}
+	expected := []string{
+		`annotation "oneway" cannot be applied to a struct`,
+		`unknown annotation "colour"`,
+		`unknown annotation "since"`,
+		`annotation "id": "three" is not an integer`,
+		`method Events.Tick: oneway methods may not have results`,
+		`annotation "id" cannot be applied to a const`,
+	}
+	for i, message := range expected {
+		if diagnostics[i].Message != message {
+			t.Errorf("diagnostic #%d is %q, expected %q", i+1, diagnostics[i].Message, message)
+		}
+	}
+}
+
+func TestDerivedTypes(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Image struct {
+	Width, Height uint32
+}
+
+type Timestamp uint64
+
+type Picture = Image
+type Frame Image
+type ImageID Timestamp
+type Count uint32
+`)
+	image := findDecl(t, pkg, "Image")
+	timestamp := findDecl(t, pkg, "Timestamp")
+	for _, e := range []struct {
+		name        string
+		isAlias     bool
+		derivedFrom Decl
+	}{
+		{"Image", false, nil},
+		{"Picture", true, image},
+		{"Frame", false, image},
+		{"ImageID", false, timestamp},
+		{"Count", false, nil},
+	} {
+		d := findDecl(t, pkg, e.name).(interface {
+			IsAlias() bool
+			DerivedFrom() Decl
+		})
+		if d.IsAlias() != e.isAlias {
+			t.Errorf("%s: IsAlias is %v", e.name, d.IsAlias())
+		}
+		if d.DerivedFrom() != e.derivedFrom {
+			t.Errorf("%s: DerivedFrom is %v", e.name, d.DerivedFrom())
+		}
+	}
+}
+
+func TestGenerics(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Image struct {
+	Width uint32
+}
+
+type Page[T any] struct {
+	Items []T
+	Next  string
+}
+
+type Pair[K comparable, V any] map[K]V
+
+type Box[T any] struct {
+	Value T
+	Count int32
+}
+
+type Album struct {
+	Pages []Page[Image]
+	Index Pair[string, Image]
+}
+
+type Service interface {
+	Get(page Page[Image]) (Page[string], error)
+}
+`)
+	page := findDecl(t, pkg, "Page").(*StructDecl)
+	params := page.TypeParams()
+	if len(params) != 1 || params[0].Name != "T" || params[0].Constraint != "any" {
+		t.Errorf("Page type parameters: %v", params)
+	}
+	pair := findDecl(t, pkg, "Pair").(*MapDecl)
+	if params := pair.TypeParams(); len(params) != 2 || params[0].Constraint != "comparable" {
+		t.Errorf("Pair type parameters: %v", params)
+	}
+	if findDecl(t, pkg, "Album").(*StructDecl).IsGeneric() {
+		t.Errorf("Album is not generic")
+	}
+	if box := findDecl(t, pkg, "Box").(*StructDecl); sizeof(box.Object.Type()) != 0 || box.Fields[1].Offset() != 0 {
+		t.Errorf("Box has a layout but depends on its type argument")
+	}
+
+	expected := []struct {
+		typeName string
+		generic  Decl
+	}{
+		{"Page[Image]", page},
+		{"Pair[string, Image]", pair},
+		{"Page[string]", page},
+	}
+	if len(pkg.Instances) != len(expected) {
+		t.Fatalf("%d instances, expected %d", len(pkg.Instances), len(expected))
+	}
+	for i, e := range expected {
+		instance := pkg.Instances[i]
+		if instance.TypeName != e.typeName || instance.Generic != e.generic {
+			t.Errorf("instance #%d: %s, expected %s", i+1, instance.TypeName, e.typeName)
+		}
+	}
+}
+
+func TestTargetABI(t *testing.T) {
+	const source = `package test
+
+type Record struct {
+	Flag  bool
+	Count int64
+	Name  string
+}
+`
+	defer SetABI("amd64", false)
+	for _, e := range []struct {
+		arch    string
+		packed  bool
+		offsets []int
+		size    int
+	}{
+		{"amd64", false, []int{0, 8, 16}, 32},
+		{"arm", false, []int{0, 4, 12}, 20},
+		{"amd64", true, []int{0, 1, 9}, 25},
+	} {
+		if err := SetABI(e.arch, e.packed); err != nil {
+			t.Fatal(err)
+		}
+		record := findDecl(t, parseSource(t, source), "Record").(*StructDecl)
+		for i, field := range record.Fields {
+			if field.Offset() != e.offsets[i] {
+				t.Errorf("%s: %s offset is %d, expected %d", TargetABI, field.Name(), field.Offset(), e.offsets[i])
+			}
+		}
+		if size := sizeof(record.Object.Type()); size != e.size {
+			t.Errorf("%s: Record size is %d, expected %d", TargetABI, size, e.size)
+		}
+	}
+	fixed := parseSource(t, `package test
+
+type Point struct {
+	X, Y float64
+}
+
+type Shape struct {
+	Corners [4]Point
+	Closed  bool
+}
+
+type Path struct {
+	Points []Point
+}
+
+type Label struct {
+	At   Point
+	Text string
+}
+
+type Counted struct {
+	A int
+	B int32
+}
+
+type Sized struct {
+	A int64
+	B int32
+}
+`)
+	for name, expected := range map[string]bool{"Point": true, "Shape": true, "Path": false, "Label": false, "Counted": false, "Sized": true} {
+		if findDecl(t, fixed, name).(*StructDecl).IsFixedLayout() != expected {
+			t.Errorf("%s: IsFixedLayout is not %v", name, expected)
+		}
+	}
+	if err := SetABI("vax", false); err == nil {
+		t.Errorf("unsupported architecture accepted")
+	}
+}
+
+func TestAnonymousStructs(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Image struct {
+	Meta struct {
+		Key, Value string
+		Extra      *struct{ Note string }
+	}
+	Tags  []struct{ Name string }
+	Names map[string]struct{}
+}
+
+type Store interface {
+	Put(opts struct{ Sync bool })
+}
+`)
+	var names []string
+	for _, d := range pkg.Decls {
+		names = append(names, d.Name())
+	}
+	if s := strings.Join(names, " "); s != "Image_Meta_Extra Image_Meta Image_Tags_Elem Image Store_Put_opts Store" {
+		t.Fatalf("declarations %s", s)
+	}
+	meta := findDecl(t, pkg, "Image_Meta").(*StructDecl)
+	if !meta.IsSynthesized || findDecl(t, pkg, "Image").(*StructDecl).IsSynthesized {
+		t.Errorf("IsSynthesized not set as expected")
+	}
+	if name := meta.Fields[2].TypeName(); name != "*Image_Meta_Extra" {
+		t.Errorf("Image_Meta.Extra has type %q", name)
+	}
+	image := findDecl(t, pkg, "Image").(*StructDecl)
+	for i, expected := range []string{"Image_Meta", "[]Image_Tags_Elem", "map[string]struct{}"} {
+		if name := image.Fields[i].TypeName(); name != expected {
+			t.Errorf("Image.%s has type %q, expected %q", image.Fields[i].Name(), name, expected)
+		}
+	}
+	put := findDecl(t, pkg, "Store").(*InterfaceDecl).Methods[0]
+	if name := put.Args[0].TypeName(); name != "Store_Put_opts" {
+		t.Errorf("Store.Put argument has type %q", name)
+	}
+}
+
+func TestValues(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+const MaxRetries = 5
+
+type Endpoint struct {
+	Host string
+	Port uint16
+}
+
+type Config struct {
+	Retries   int
+	Timeout   float64
+	Endpoints []Endpoint
+	Limits    map[string]int
+	Backup    *Endpoint
+	Name      string
+}
+
+var DefaultConfig = Config{
+	Retries:   MaxRetries,
+	Timeout:   2.5,
+	Endpoints: []Endpoint{{"localhost", 8080}, {Host: "backup"}},
+	Limits:    map[string]int{"conns": 10},
+	Backup:    nil,
+}
+
+var Ports = [4]uint16{2: 80, 443}
+`)
+	config := findDecl(t, pkg, "DefaultConfig").(*ValueDecl)
+	if !config.IsValue() || config.TypeName() != "Config" {
+		t.Fatalf("DefaultConfig is %s %s", config.Kind(), config.TypeName())
+	}
+	value := config.Value
+	if !value.IsStruct() || len(value.Fields) != 6 {
+		t.Fatalf("DefaultConfig value has kind %d and %d fields", value.Kind, len(value.Fields))
+	}
+	if f := value.Fields[0]; !f.IsSet || f.Value.Literal() != "5" || f.Value.TypeName() != "int" {
+		t.Errorf("Retries = %s (%s)", f.Value.Literal(), f.Value.TypeName())
+	}
+	if f := value.Fields[1]; f.Value.Literal() != "2.5" {
+		t.Errorf("Timeout = %s", f.Value.Literal())
+	}
+	endpoints := value.Fields[2].Value
+	if !endpoints.IsArray() || len(endpoints.Elems) != 2 || endpoints.TypeName() != "[]Endpoint" {
+		t.Fatalf("Endpoints has %d elements of type %s", len(endpoints.Elems), endpoints.TypeName())
+	}
+	backup := endpoints.Elems[1]
+	if backup.Fields[0].Value.Literal() != `"backup"` || backup.Fields[1].IsSet || !backup.Fields[1].Value.IsZero() {
+		t.Errorf("Endpoints[1] not evaluated as expected")
+	}
+	limits := value.Fields[3].Value
+	if !limits.IsMap() || len(limits.Entries) != 1 || limits.Entries[0].Key.Literal() != `"conns"` {
+		t.Errorf("Limits not evaluated as expected")
+	}
+	if f := value.Fields[4]; !f.IsSet || !f.Value.IsZero() {
+		t.Errorf("Backup should be set to nil")
+	}
+	if f := value.Fields[5]; f.IsSet || !f.Value.IsZero() {
+		t.Errorf("Name should be unset")
+	}
+
+	var literals []string
+	for _, elem := range findDecl(t, pkg, "Ports").(*ValueDecl).Value.Elems {
+		literals = append(literals, elem.Literal())
+	}
+	if s := strings.Join(literals, ","); s != ",,80,443" {
+		t.Errorf("Ports = %s", s)
+	}
+}
+
+func TestSymbolicArrayLengths(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+const MaxName = 32
+
+type Name [MaxName]byte
+
+type Grid [MaxName][MaxName * 2]int32
+
+type Record struct {
+	Name  [MaxName]byte
+	Flags [4]bool
+	Names []*[MaxName]byte
+}
+`)
+	name := findDecl(t, pkg, "Name").(*ArrayDecl)
+	if name.Length() != 32 || name.LengthExpr() != "MaxName" {
+		t.Errorf("Name has length %d, %q", name.Length(), name.LengthExpr())
+	}
+	if name.LengthConst() != findDecl(t, pkg, "MaxName") {
+		t.Errorf("Name's length not linked to MaxName")
+	}
+	grid := findDecl(t, pkg, "Grid").(*ArrayDecl)
+	if grid.ElTypeName() != "[MaxName * 2]int32" || grid.LengthConst() == nil {
+		t.Errorf("Grid has element type %q", grid.ElTypeName())
+	}
+	record := findDecl(t, pkg, "Record").(*StructDecl)
+	for i, expected := range []string{"[MaxName]byte", "[4]bool", "[]*[MaxName]byte"} {
+		if name := record.Fields[i].TypeName(); name != expected {
+			t.Errorf("Record.%s has type %q, expected %q", record.Fields[i].Name(), name, expected)
+		}
+	}
+	initTypeMap()
+	if cpp := mustMap(t, cppType, record.Fields[0].TypeName()); cpp != "std::array<std::byte, MaxName>" {
+		t.Errorf("Record.Name has C++ type %q", cpp)
+	}
+}
+
+func TestEnums(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type ColorComponent uint8
+
+const (
+	RedComponent ColorComponent = iota + 1
+	GreenComponent
+	BlueComponent
+)
+
+type Level int
+
+const (
+	LevelLow    Level = -1
+	LevelNormal Level = 0
+	LevelHigh   Level = 5
+	LevelMax    Level = 5
+	LevelTop    Level = 7
+)
+
+type Bit uint8
+
+const BitZero Bit = 0
+
+type Step int
+
+const (
+	StepIdle Step = iota
+	StepIn
+)
+`)
+	for i := 0; i < 10; i++ {
+		context := NewContext(".", nil, pkg)
+		var names []string
+		for _, e := range context.Enums {
+			names = append(names, e.Type.Name())
+		}
+		if s := strings.Join(names, " "); s != "ColorComponent Level Bit Step" {
+			t.Fatalf("enums ordered %s", s)
+		}
+	}
+	enums := NewContext(".", nil, pkg).Enums
+
+	component := enums[0]
+	if component.Count() != 3 || component.Min() != 1 || component.Max() != 3 || component.HasDuplicates() || component.Default() != nil {
+		t.Errorf("ColorComponent: count %d, min %d, max %d", component.Count(), component.Min(), component.Max())
+	}
+	var short []string
+	for _, e := range component.Enumerators {
+		short = append(short, e.ShortName())
+	}
+	if s := strings.Join(short, " "); s != "Red Green Blue" {
+		t.Errorf("ColorComponent short names %s", s)
+	}
+
+	level := enums[1]
+	if level.Min() != -1 || level.Max() != 7 || !level.HasDuplicates() || level.Default() == nil || level.Default().Name() != "LevelNormal" {
+		t.Errorf("Level: min %d, max %d, duplicates %v", level.Min(), level.Max(), level.HasDuplicates())
+	}
+	if s := level.Enumerators[4].ShortName(); s != "Top" {
+		t.Errorf("LevelTop's short name is %q", s)
+	}
+	if d := enums[2].Default(); d == nil || d.ShortName() != "Zero" {
+		t.Errorf("Bit has no default")
+	}
+	if s := enums[3].Enumerators[1].ShortName(); s != "In" {
+		t.Errorf("StepIn's short name is %q", s)
+	}
+
+	service, err := checkFiles([]string{filepath.Join("tests", "service", "protocol.ridl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	short = nil
+	for _, e := range NewContext(".", nil, service).Enums[0].Enumerators {
+		short = append(short, e.ShortName())
+	}
+	if s := strings.Join(short, " "); s != "Red Green Blue Alpha" {
+		t.Errorf("tests/service ColorComponent short names %s", s)
+	}
+}
+
+func TestStringAndFlagEnums(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Codec string
+
+const (
+	CodecNone Codec = ""
+	CodecH264 Codec = "h264"
+	CodecVP9  Codec = "vp9"
+)
+
+type Perm uint32
+
+const (
+	Read Perm = 1 << iota
+	Write
+)
+
+type Access uint8
+
+const (
+	AccessNone Access = 0
+	AccessRead Access = 1 << (iota - 1)
+	AccessWrite
+	AccessExec
+	AccessAdmin
+	AccessAll = AccessRead | AccessWrite | AccessExec | AccessAdmin
+)
+
+type Mode uint8
+
+const (
+	ModeA Mode = 1
+	ModeB Mode = 3
+)
+
+type State int
+
+const (
+	StateIdle State = iota
+	StateRunning
+	StateDone
+)
+
+type Bool int
+
+const (
+	False Bool = iota
+	True
+)
+
+type Pair int
+
+const (
+	PairLeft Pair = iota + 1
+	PairRight
+)
+`)
+	enums := NewContext(".", nil, pkg).Enums
+	if len(enums) != 7 {
+		t.Fatalf("%d enums, expected 7", len(enums))
+	}
+	codec, perm, access, mode := enums[0], enums[1], enums[2], enums[3]
+	if !codec.IsString || codec.IsDense || codec.IsFlags() || codec.HasDuplicates() || codec.Default() != codec.Enumerators[0] {
+		t.Errorf("Codec not a string enum as expected")
+	}
+	if codec.Enumerators[1].ShortName() != "H264" {
+		t.Errorf("CodecH264's short name is %q", codec.Enumerators[1].ShortName())
+	}
+	if perm.IsString || !perm.IsFlags() || perm.Mask() != 3 {
+		t.Errorf("Perm: flags %v, mask %d", perm.IsFlags(), perm.Mask())
+	}
+	if !access.IsFlags() || access.Mask() != 15 || access.Count() != 6 {
+		t.Errorf("Access: flags %v, mask %d, count %d", access.IsFlags(), access.Mask(), access.Count())
+	}
+	if mode.IsFlags() || mode.Mask() != 3 {
+		t.Errorf("Mode: flags %v, mask %d", mode.IsFlags(), mode.Mask())
+	}
+	for _, e := range enums[4:] {
+		if e.IsFlags() {
+			t.Errorf("%s: iota enum classified as flags", e.Type.Name())
+		}
+	}
+}
+
+func TestTypeRefs(t *testing.T) {
+	root := t.TempDir()
+	writeSources(t, root, map[string]string{"proto/common/common.ridl": `package common
+
+type Timestamp struct {
+	Secs uint64
+}
+`})
+
+	*importDirs = StringSlice{root}
+	defer func() { *importDirs = StringSlice{} }()
+
+	pkg := parseSource(t, `package test
+
+import "proto/common"
+
+const MaxName = 16
+
+type Point struct {
+	X, Y float64
+}
+
+type Record struct {
+	Name   [MaxName]byte
+	Points []Point
+	Index  map[string]*Point
+	Tags   map[string]struct{}
+	When   common.Timestamp
+}
+
+type Names []string
+
+type Service interface {
+	Find(name string) *Record
+}
+`)
+	imported := pkg.ImportedPackages[0]
+	record := findDecl(t, pkg, "Record").(*StructDecl)
+	must := func(ref *TypeRef, err error) *TypeRef {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+
+	name := must(record.Fields[0].Type())
+	if !name.IsArray() || name.Len != 16 || name.LengthExpr != "MaxName" || name.Elem.Name != "byte" || !name.Elem.IsBasic() {
+		t.Errorf("Record.Name has type %s %v %d %q", name.Kind, name.Elem, name.Len, name.LengthExpr)
+	}
+	points := must(record.Fields[1].Type())
+	if !points.IsSlice() || !points.Elem.IsNamed() || points.Elem.Decl() != findDecl(t, pkg, "Point") {
+		t.Errorf("Record.Points has type %s of %v", points.Kind, points.Elem)
+	}
+	index := must(record.Fields[2].Type())
+	if !index.IsMap() || index.Key.Name != "string" || !index.Elem.IsOptional() || index.Elem.Elem.Name != "Point" {
+		t.Errorf("Record.Index has type %s", index)
+	}
+	if tags := must(record.Fields[3].Type()); !tags.IsSet() {
+		t.Errorf("Record.Tags is not a set")
+	}
+	when := must(record.Fields[4].Type())
+	if when.Package() != imported || when.Decl() != findDecl(t, imported, "Timestamp") || when.QualifiedName() != "common.Timestamp" {
+		t.Errorf("Record.When has type %s from %v", when.QualifiedName(), when.Package())
+	}
+	if elem := must(findDecl(t, pkg, "Names").(*ArrayDecl).ElemType()); elem.Name != "string" {
+		t.Errorf("Names has element type %s", elem)
+	}
+	if must(record.Type()).Decl() != record {
+		t.Errorf("Record's TypeRef not linked to its declaration")
+	}
+
+	initTypeMap()
+	for i, expected := range []string{
+		"std::array<std::byte, MaxName>",
+		"std::vector<Point>",
+		"std::map<std::string, std::optional<Point>>",
+		"std::set<std::string>",
+		"common::Timestamp",
+	} {
+		if cpp := mustMap(t, cppType, must(record.Fields[i].Type())); cpp != expected {
+			t.Errorf("Record.%s has C++ type %q, expected %q", record.Fields[i].Name(), cpp, expected)
+		}
+		if cpp, old := mustMap(t, cppType, must(record.Fields[i].Type())), mustMap(t, cppType, record.Fields[i].TypeName()); cpp != old {
+			t.Errorf("Record.%s maps to %q, by name to %q", record.Fields[i].Name(), cpp, old)
+		}
+	}
+	find := findDecl(t, pkg, "Service").(*InterfaceDecl).Methods[0]
+	if arg := mustMap(t, argType, must(find.Args[0].Type())); arg != "const std::string &" {
+		t.Errorf("Find's argument has C++ type %q", arg)
+	}
+	if _, err := pkg.typeRef(types.NewChan(types.SendRecv, types.Typ[types.Int])); err == nil {
+		t.Errorf("typeRef accepted a channel type")
+	}
+	if derived := must(findDecl(t, pkg, "Names").(*ArrayDecl).DerivedType()); derived != nil {
+		t.Errorf("Names is derived from %s", derived)
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Tree struct {
+	Root   Node
+	Lookup Index
+}
+
+type Index map[string]*Node
+
+type Node struct {
+	Name     string
+	Children Nodes
+	Meta     Meta
+	Parents  []Node
+}
+
+type Nodes []Node
+
+type Meta struct {
+	Owners []Tree
+	Size   Size
+}
+
+type Size [2]int32
+
+type Walker interface {
+	Visit(n Node) bool
+}
+
+type Leaf struct {
+	Next []Leaf
+}
+`)
+	context := NewContext("", nil, pkg)
+	var names []string
+	for _, d := range context.DependencyOrder {
+		names = append(names, d.Name())
+	}
+	if order := strings.Join(names, " "); order != "Size Index Nodes Meta Node Tree Walker Leaf" {
+		t.Errorf("dependency order %q", order)
+	}
+	if len(context.Cycles) != 1 {
+		t.Fatalf("%d cycles, expected 1", len(context.Cycles))
+	}
+	if n := len(context.Cycles[0]); n != 5 {
+		t.Errorf("cycle of %d declarations, expected 5", n)
+	}
+	for _, name := range []string{"Tree", "Node", "Nodes", "Index", "Meta", "Size", "Leaf"} {
+		d := findDecl(t, pkg, name).(interface{ NeedsForwardDecl() bool })
+		expected := name == "Tree" || name == "Node"
+		if d.NeedsForwardDecl() != expected {
+			t.Errorf("%s.NeedsForwardDecl() == %v, expected %v", name, d.NeedsForwardDecl(), expected)
+		}
+	}
+}
+
+func TestRecursiveOptionals(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Node struct {
+	Value int32
+	Next  *Node
+}
+
+type A struct {
+	B *B
+}
+
+type B struct {
+	A A
+	C *C
+}
+
+type C struct {
+	Nodes []Node
+	Self  []*C
+}
+`)
+	var names []string
+	for _, d := range NewContext("", nil, pkg).DependencyOrder {
+		names = append(names, d.Name())
+	}
+	if s := strings.Join(names, " "); s != "Node C A B" {
+		t.Errorf("dependency order %q", s)
+	}
+	for name, expected := range map[string]bool{"Node": false, "A": false, "B": true, "C": false} {
+		d := findDecl(t, pkg, name).(interface{ NeedsForwardDecl() bool })
+		if d.NeedsForwardDecl() != expected {
+			t.Errorf("%s.NeedsForwardDecl() == %v, expected %v", name, d.NeedsForwardDecl(), expected)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+const PackageID uint16 = 0x12
+
+type Base interface {
+	Ping()
+}
+
+type Service interface {
+	Base
+	Add(a, b int32) (sum int32, err error)
+	//ridl:oneway
+	Notify(message string)
+}
+`)
+	context := NewContext("", nil, pkg)
+	expected := []struct {
+		name     string
+		fields   int
+		hasError bool
+	}{
+		{"Base_Ping_Request", 0, false},
+		{"Base_Ping_Response", 0, false},
+		{"Service_Add_Request", 2, false},
+		{"Service_Add_Response", 1, true},
+	}
+	if len(context.Messages) != len(expected)+1 {
+		t.Fatalf("%d messages, expected %d", len(context.Messages), len(expected)+1)
+	}
+	for i, m := range context.Messages[:len(expected)] {
+		if m.Name != expected[i].name || len(m.Fields) != expected[i].fields || m.ID != m.Method.ID*2+i%2 {
+			t.Errorf("message %d is %s, %d fields, ID %d", i, m.Name, len(m.Fields), m.ID)
+		}
+		if m.HasError() != expected[i].hasError {
+			t.Errorf("%s: HasError is %v", m.Name, m.HasError())
+		}
+		if m.Code != 0x12<<16|uint32(m.ID) {
+			t.Errorf("%s has code %#x", m.Name, m.Code)
+		}
+		if m.IsRequest() != (i%2 == 0) || m.Peer().Peer() != m {
+			t.Errorf("%s is a %s", m.Name, m.Direction)
+		}
+	}
+	add := context.Messages[2]
+	if add.Interface != findDecl(t, pkg, "Service") || add.Method.Request != add || add.Fields[1].Name() != "b" {
+		t.Errorf("Service_Add_Request not linked to its method")
+	}
+	if sum := context.Messages[3].Fields; sum[0].Name() != "sum" {
+		t.Errorf("Service_Add_Response has field %s, expected sum", sum[0].Name())
+	}
+	notify := context.Messages[4]
+	if notify.Name != "Service_Notify_Request" || notify.Peer() != nil || notify.Method.Response != nil {
+		t.Errorf("oneway method Notify has messages %s and %v", notify.Name, notify.Peer())
+	}
+}
+
+func TestErrorResults(t *testing.T) {
+	pkg := parseSource(t, `package test
+
+type Service interface {
+	Hello(name string) (message string, err error)
+	Stat(path string) (size int64, mode uint32, err error)
+	Check() error
+	Ping()
+	Last() (err error, code int32)
+}
+`)
+	methods := findDecl(t, pkg, "Service").(*InterfaceDecl).Methods
+	for i, expected := range []struct {
+		hasError bool
+		values   int
+	}{
+		{true, 1},
+		{true, 2},
+		{true, 0},
+		{false, 0},
+		{false, 2},
+	} {
+		m := methods[i]
+		if m.HasError() != expected.hasError || len(m.ValueResults()) != expected.values {
+			t.Errorf("%s: HasError %v with %d value results", m.Name(), m.HasError(), len(m.ValueResults()))
+		}
+		if m.HasError() && m.ErrorResult() != m.Results[len(m.Results)-1] {
+			t.Errorf("%s: ErrorResult is not the last result", m.Name())
+		}
+		if !m.HasError() && m.ErrorResult() != nil {
+			t.Errorf("%s: ErrorResult is not nil", m.Name())
+		}
+	}
+}
+
+func TestFingerprints(t *testing.T) {
+	fingerprints := func(source string) map[string]string {
+		t.Helper()
+		context := NewContext("", nil, parseSource(t, source))
+		fps := map[string]string{"package": context.Fingerprint()}
+		for _, d := range context.Decls {
+			fps[d.Name()] = declFingerprint(d)
+		}
+		for _, m := range context.Messages {
+			fps[m.Name] = m.Fingerprint()
+		}
+		return fps
+	}
+	base := fingerprints(`package test
+
+type Color uint8
+
+const (
+	Red Color = iota
+	Green
+)
+
+type Point struct {
+	X, Y float64
+}
+
+type Node struct {
+	At       Point
+	Children Nodes
+}
+
+type Nodes []Node
+
+type Service interface {
+	Find(at Point) (*Node, error)
+	Reset()
+}
+`)
+	reordered := fingerprints(`package test
+
+// Service is documented.
+type Service interface {
+	Reset()
+	Find(where Point) (*Node, error)
+}
+
+type Nodes []Node
+
+type Node struct {
+	At       Point
+	Children Nodes // a comment
+}
+
+const (
+	Green Color = iota + 1
+	Red   Color = 0
+)
+
+type Point struct {
+	X, Y float64
+}
+
+type Color uint8
+`)
+	for name, fp := range base {
+		if fp != reordered[name] {
+			t.Errorf("%s: fingerprint %q changed to %q by reordering", name, fp, reordered[name])
+		}
+	}
+
+	changed := fingerprints(`package test
+
+type Color uint8
+
+const (
+	Red Color = iota
+	Green
+)
+
+type Point struct {
+	X, Y float64 ` + "`ridl:\"since=2\"`" + `
+}
+
+type Node struct {
+	At       Point
+	Children Nodes
+}
+
+type Nodes []Node
+
+type Service interface {
+	Find(at Point) (*Node, error)
+	Reset()
+}
+`)
+	for name, same := range map[string]bool{
+		"Color":                 true,
+		"Point":                 false,
+		"Node":                  false,
+		"Nodes":                 false,
+		"Service":               false,
+		"Service_Find_Request":  false,
+		"Service_Reset_Request": true,
+		"package":               false,
+	} {
+		if (base[name] == changed[name]) != same {
+			t.Errorf("%s: fingerprint %q, %q after changing Point", name, base[name], changed[name])
+		}
+	}
+
+	renamed := fingerprints(`package test
+
+type Colour uint8
+
+const (
+	Rouge Colour = iota
+	Vert
+)
+
+type Point struct {
+	X, Y float64
+}
+
+type Node struct {
+	At       Point
+	Children Nodes
+}
+
+type Nodes []Node
+
+type Service interface {
+	Find(at Point) (*Node, error)
+	Reset()
+}
+`)
+	if renamed["Colour"] != base["Color"] {
+		t.Errorf("Color: fingerprint %q changed to %q by renaming", base["Color"], renamed["Colour"])
+	}
+	if renamed["package"] == base["package"] {
+		t.Errorf("package fingerprint unchanged by renaming Color")
+	}
+
+	const cyclic = `package test
+
+type Tree struct {
+	Children Forest
+}
+
+type Forest struct {
+	Trees []Tree
+}
+`
+	first := parseSource(t, cyclic)
+	tree, forest := findDecl(t, first, "Tree"), findDecl(t, first, "Forest")
+	treeFirst, forestSecond := declFingerprint(tree), declFingerprint(forest)
+	second := parseSource(t, cyclic)
+	tree, forest = findDecl(t, second, "Tree"), findDecl(t, second, "Forest")
+	forestFirst, treeSecond := declFingerprint(forest), declFingerprint(tree)
+	if treeFirst != treeSecond || forestFirst != forestSecond {
+		t.Errorf("cyclic fingerprints depend on the order they are computed")
+	}
+	if len(second.fingerprints) != 0 {
+		t.Errorf("fingerprints of cycle members were cached")
+	}
+
+	// An anonymous struct is described as a declared one, by its
+	// fields' wire names.
+	pkg := parseSource(t, "package test\n\ntype Named struct {\n\tX int `ridl:\"name=x,since=2\"`\n}\n")
+	anonymous := types.NewStruct(
+		[]*types.Var{types.NewField(token.NoPos, nil, "X", types.Typ[types.Int], false)},
+		[]string{`ridl:"name=x,since=2"`})
+	f := &fingerprinter{pkg: pkg}
+	if named, s := f.canonical(findDecl(t, pkg, "Named")), f.typeString(anonymous); named != s || s != "struct{x int since=2}" {
+		t.Errorf("anonymous struct described as %q, declared struct as %q", s, named)
+	}
+}
@@ -0,0 +1,330 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// A fingerprint is a hash of the canonical form of a type, interface
+// or message, used by the peers of a protocol to check they agree on
+// its definition. The canonical form describes a declaration's
+// structure and the attributes that affect its representation on the
+// wire: the types and wire names of struct fields, in order, and their
+// ridl tag options; array lengths; enumerator values; interface,
+// method and message IDs and the types of methods' arguments and
+// results. Comments, the names of types, enumerators and method
+// arguments and the order of declarations, and of methods, do not
+// contribute. A package's fingerprint, in contrast, covers the names
+// of its types and interfaces, as peers refer to them by name, along
+// with their fingerprints and the package's PackageID.
+//
+// Declared types are described by their structure, not their names.
+// A type referring to itself, directly or via others on a dependency
+// cycle, is described by a reference to the enclosing description.
+
+// fingerprintVersion identifies the canonical form. It is hashed with
+// the canonical form so a change of form changes every fingerprint.
+const fingerprintVersion = "ridl-fingerprint-1"
+
+// fingerprintOf returns the fingerprint of the canonical form s, the
+// first 64 bits of its SHA-256 hash in hex.
+func fingerprintOf(s string) string {
+	sum := sha256.Sum256([]byte(fingerprintVersion + "\n" + s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Fingerprint returns the fingerprint of a type or interface
+// declaration, or an empty string for other declarations.
+func (d *decl) Fingerprint() string {
+	switch d.kind {
+	case DeclKindTypedef, DeclKindArray, DeclKindStruct, DeclKindMap, DeclKindInterface:
+		return d.pkg.fingerprint(d.pkg.Lookup(d.Object))
+	}
+	return ""
+}
+
+// Fingerprint returns the fingerprint of the message.
+func (m *Message) Fingerprint() string {
+	f := &fingerprinter{pkg: m.Method.pkg}
+	var b strings.Builder
+	fmt.Fprintf(&b, "message %#x %s(", m.Code, m.Direction)
+	f.writeArgs(&b, m.Fields)
+	b.WriteString(")")
+	if m.HasError() {
+		b.WriteString(" error")
+	}
+	return fingerprintOf(b.String())
+}
+
+// Fingerprint returns the fingerprint of the package, a hash of its
+// PackageID and of the names and fingerprints of its types and
+// interfaces.
+func (p *Package) Fingerprint() string {
+	var lines []string
+	for _, d := range p.Decls {
+		if fp := declFingerprint(d); fp != "" {
+			lines = append(lines, fmt.Sprintf("%s %s %s", d.Kind(), d.Name(), fp))
+		}
+	}
+	sort.Strings(lines)
+	id, _ := p.packageID()
+	return fingerprintOf(fmt.Sprintf("package %#x\n%s", id, strings.Join(lines, "\n")))
+}
+
+func declFingerprint(d Decl) string {
+	return d.(interface{ Fingerprint() string }).Fingerprint()
+}
+
+// fingerprint returns the fingerprint of the declaration d.
+// Fingerprints of declarations that are not on a dependency cycle do
+// not depend on where they are computed from and are cached.
+func (p *Package) fingerprint(d Decl) string {
+	obj := declObject(d)
+	if fp, found := p.fingerprints[obj]; found {
+		return fp
+	}
+	f := &fingerprinter{pkg: p}
+	fp := fingerprintOf(f.canonical(d))
+	if p.onCycle(d) {
+		return fp
+	}
+	if p.fingerprints == nil {
+		p.fingerprints = make(map[types.Object]string)
+	}
+	p.fingerprints[obj] = fp
+	return fp
+}
+
+// onCycle returns true if d is on one of the receiver's dependency
+// cycles.
+func (p *Package) onCycle(d Decl) bool {
+	for _, cycle := range p.cycles {
+		for _, member := range cycle {
+			if member == d {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A fingerprinter computes canonical forms. Its stack holds the
+// declarations being described, innermost last.
+type fingerprinter struct {
+	pkg   *Package
+	stack []Decl
+}
+
+// canonical returns the canonical form of the declaration d.
+func (f *fingerprinter) canonical(d Decl) string {
+	f.stack = append(f.stack, d)
+	defer func() { f.stack = f.stack[:len(f.stack)-1] }()
+	var b strings.Builder
+	switch d := d.(type) {
+	case *TypedefDecl:
+		b.WriteString("type ")
+		b.WriteString(f.typeString(d.Object.Type().Underlying()))
+		f.writeEnumerators(&b, d)
+	case *ArrayDecl, *MapDecl:
+		b.WriteString(f.typeString(declObject(d).Type().Underlying()))
+	case *StructDecl:
+		f.writeTypeParams(&b, d.TypeParams())
+		b.WriteString("struct{")
+		for i, field := range d.Fields {
+			if i != 0 {
+				b.WriteString("; ")
+			}
+			f.writeField(&b, field)
+		}
+		b.WriteString("}")
+	case *InterfaceDecl:
+		methods := append([]*MethodDecl(nil), d.Methods...)
+		sort.Slice(methods, func(i, j int) bool {
+			if methods[i].ID != methods[j].ID {
+				return methods[i].ID < methods[j].ID
+			}
+			return methods[i].Name() < methods[j].Name()
+		})
+		fmt.Fprintf(&b, "interface %d{", d.ID)
+		for i, m := range methods {
+			if i != 0 {
+				b.WriteString("; ")
+			}
+			fmt.Fprintf(&b, "%d(", m.ID)
+			f.writeArgs(&b, m.Args)
+			b.WriteString(")(")
+			f.writeArgs(&b, m.Results)
+			b.WriteString(")")
+			if m.HasAnnotation("oneway") {
+				b.WriteString(" oneway")
+			}
+		}
+		b.WriteString("}")
+	default:
+		panic(fmt.Errorf("%T: no canonical form", d))
+	}
+	return b.String()
+}
+
+func (f *fingerprinter) writeArgs(b *strings.Builder, args []*MethodArg) {
+	for i, arg := range args {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(f.typeString(arg.Object.Type()))
+	}
+}
+
+func (f *fingerprinter) writeTypeParams(b *strings.Builder, params []*TypeParam) {
+	if len(params) != 0 {
+		fmt.Fprintf(b, "generic[%d] ", len(params))
+	}
+}
+
+// writeEnumerators writes the values of the constants of the typedef's
+// type, in order.
+func (f *fingerprinter) writeEnumerators(b *strings.Builder, typedef *TypedefDecl) {
+	var enumerators []*ConstDecl
+	for _, d := range f.pkg.Decls {
+		if c, ok := d.(*ConstDecl); ok && types.Identical(c.Object.Type(), typedef.Object.Type()) {
+			enumerators = append(enumerators, c)
+		}
+	}
+	if len(enumerators) == 0 {
+		return
+	}
+	sort.Slice(enumerators, func(i, j int) bool {
+		return constant.Compare(enumerators[i].Value(), token.LSS, enumerators[j].Value())
+	})
+	b.WriteString(" enum{")
+	for i, c := range enumerators {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(c.ExactValue())
+	}
+	b.WriteString("}")
+}
+
+// writeField writes the canonical form of a struct field, its wire
+// name, type and ridl tag options.
+func (f *fingerprinter) writeField(b *strings.Builder, field *StructField) {
+	if field.IsEmbedded {
+		b.WriteString("embed ")
+	} else {
+		b.WriteString(field.WireName() + " ")
+	}
+	b.WriteString(f.typeString(field.Object.Type()))
+	if field.Optional {
+		b.WriteString(" optional")
+	}
+	if field.HasDefault {
+		fmt.Fprintf(b, " default=%q", field.Default)
+	}
+	if field.Since != 0 {
+		fmt.Fprintf(b, " since=%d", field.Since)
+	}
+}
+
+// ref returns the description of a reference to the declaration d,
+// a reference to an enclosing description, the fingerprint of d or,
+// for declarations on a cycle, the canonical form of d.
+func (f *fingerprinter) ref(p *Package, d Decl) string {
+	for i := len(f.stack) - 1; i >= 0; i-- {
+		if f.stack[i] == d {
+			return fmt.Sprintf("^%d", len(f.stack)-1-i)
+		}
+	}
+	if p != f.pkg || !p.onCycle(d) {
+		return "#" + p.fingerprint(d)
+	}
+	return "(" + f.canonical(d) + ")"
+}
+
+// typeString returns the canonical form of the type t.
+func (f *fingerprinter) typeString(t types.Type) string {
+	switch t := types.Unalias(t).(type) {
+	case *types.Basic:
+		return t.Name()
+	case *types.Named:
+		obj := t.Origin().Obj()
+		var s string
+		if p := f.pkg.packageOf(obj.Pkg()); p != nil && p.Lookup(obj) != nil {
+			s = f.ref(p, p.Lookup(obj))
+		} else if obj.Pkg() == nil {
+			s = obj.Name()
+		} else {
+			s = obj.Pkg().Path() + "." + obj.Name()
+		}
+		if args := t.TypeArgs(); args.Len() != 0 {
+			list := make([]string, args.Len())
+			for i := range list {
+				list[i] = f.typeString(args.At(i))
+			}
+			s += "[" + strings.Join(list, ", ") + "]"
+		}
+		return s
+	case *types.TypeParam:
+		return fmt.Sprintf("$%d", t.Index())
+	case *types.Pointer:
+		return "*" + f.typeString(t.Elem())
+	case *types.Slice:
+		return "[]" + f.typeString(t.Elem())
+	case *types.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), f.typeString(t.Elem()))
+	case *types.Map:
+		return "map[" + f.typeString(t.Key()) + "]" + f.typeString(t.Elem())
+	case *types.Struct:
+		if named, found := f.pkg.anonymous[t]; found {
+			return f.typeString(named)
+		}
+		var b strings.Builder
+		b.WriteString("struct{")
+		for i := 0; i < t.NumFields(); i++ {
+			if i != 0 {
+				b.WriteString("; ")
+			}
+			field := NewStructField(f.pkg, t.Field(i), 0, 0)
+			field.IsEmbedded = t.Field(i).Anonymous()
+			_ = field.setTags(t.Tag(i)) // checked by validatePackage
+			f.writeField(&b, field)
+		}
+		b.WriteString("}")
+		return b.String()
+	}
+	return t.String()
+}
+
+//  ================================================================
+
+// printFingerprints writes the fingerprint table of the context's
+// package, the fingerprints of the package, its types, interfaces and
+// messages.
+func printFingerprints(w io.Writer, context *Context) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "package\t%s\t%s\n", context.PackageName, context.Fingerprint())
+	for _, d := range context.Decls {
+		if fp := declFingerprint(d); fp != "" {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Kind(), d.Name(), fp)
+		}
+	}
+	for _, m := range context.Messages {
+		fmt.Fprintf(tw, "message\t%s\t%s\n", m.Name, m.Fingerprint())
+	}
+	return tw.Flush()
+}
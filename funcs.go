@@ -9,21 +9,19 @@ package main
 
 import (
 	"fmt"
+	"go/ast"
+	"go/parser"
 	"go/types"
 	"io"
 	"log"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
 )
 
-var (
-	arrayDimensionsPattern = regexp.MustCompile("^\\[(.*)\\](.*)")
-	mapKeyValuePattern     = regexp.MustCompile("^map\\[(.*)\\](.*)")
-)
-
-func cpptype(fullType string, asArg bool) string {
+// cppTypeRef maps the type described by a TypeRef to C++.
+func cppTypeRef(ref *TypeRef, asArg bool) string {
 	result := func(t string, byRef bool) string {
 		if asArg && byRef {
 			return fmt.Sprintf("const %s &", t)
@@ -31,68 +29,165 @@ func cpptype(fullType string, asArg bool) string {
 		return t
 	}
 
-	goType := fullType
-
-	parts := arrayDimensionsPattern.FindStringSubmatch(fullType)
-	if parts != nil {
-		if len(parts) != 3 {
-			panic(fmt.Errorf("unexpected FindStringSubmatch extracting array info: %q", parts))
+	switch ref.Kind {
+	case TypeKindOptional:
+		return result(mapOptionalToCpp(cppTypeRef(ref.Elem, false)))
+	case TypeKindSlice:
+		return result(fmt.Sprintf("std::vector<%s>", cppTypeRef(ref.Elem, false)), true)
+	case TypeKindArray:
+		length := ref.LengthExpr
+		if length == "" {
+			length = fmt.Sprint(ref.Len)
 		}
+		return result(fmt.Sprintf("std::array<%s, %s>", cppTypeRef(ref.Elem, false), strings.ReplaceAll(length, ".", "::")), true)
+	case TypeKindMap:
+		if ref.IsSet() {
+			return result(fmt.Sprintf("std::set<%s>", cppTypeRef(ref.Key, false)), true)
+		}
+		return result(fmt.Sprintf("std::map<%s, %s>", cppTypeRef(ref.Key, false), cppTypeRef(ref.Elem, false)), true)
+	case TypeKindNamed:
+		if len(ref.Args) != 0 {
+			name, _ := mapGoToCpp(ref.QualifiedName())
+			var cargs []string
+			for _, arg := range ref.Args {
+				cargs = append(cargs, cppTypeRef(arg, false))
+			}
+			return result(fmt.Sprintf("%s<%s>", name, strings.Join(cargs, ", ")), true)
+		}
+		return result(mapGoToCpp(ref.QualifiedName()))
+	case TypeKindStruct:
+		return result("struct {}", false)
+	}
+	return result(mapGoToCpp(ref.Name))
+}
 
-		dim := strings.TrimSpace(parts[1])
-		goType = strings.TrimSpace(parts[2])
-		ctype, _ := mapGoToCpp(goType)
+// The type mapping functions accept either a *TypeRef or a Go type,
+// as a string, which is parsed and described by a TypeRef.
 
-		if dim == "" {
-			ctype = fmt.Sprintf("std::vector<%s>", ctype)
-		} else {
-			ctype = fmt.Sprintf("std::array<%s, %s>", ctype, dim)
-		}
+func cppType(t interface{}) (string, error) {
+	c, err := mapType(t, false)
+	logdebug("cpptype %v -> %q", t, c)
+	return c, err
+}
+
+func argType(t interface{}) (string, error) {
+	c, err := mapType(t, true)
+	logdebug("argtype %v -> %q", t, c)
+	return c, err
+}
 
-		return result(ctype, true)
+// mapType maps a type, named by a string or described by a TypeRef,
+// to C++.
+func mapType(t interface{}, asArg bool) (string, error) {
+	ref, err := toTypeRef(t)
+	if err != nil {
+		return "", err
 	}
+	return cppTypeRef(ref, asArg), nil
+}
 
-	parts = mapKeyValuePattern.FindStringSubmatch(fullType)
-	if parts != nil {
-		if len(parts) != 3 {
-			panic(fmt.Errorf("unexpected FindStringSubmatch extracting map info: %q", parts))
-		}
-		ctype := ""
-		gokey := strings.TrimSpace(parts[1])
-		goval := strings.TrimSpace(parts[2])
-		ckey := cpptype(gokey, false)
-		if goval == "struct{}" {
-			ctype = fmt.Sprintf("std::set<%s>", ckey)
-		} else {
-			cval := cpptype(goval, false)
-			ctype = fmt.Sprintf("std::map<%s, %s>", ckey, cval)
+// toTypeRef returns the TypeRef describing t, a *TypeRef or a Go type
+// as a string.
+func toTypeRef(t interface{}) (*TypeRef, error) {
+	switch t := t.(type) {
+	case *TypeRef:
+		return t, nil
+	case string:
+		expr, err := parseTypeExpr(t)
+		if err != nil {
+			return nil, err
 		}
-		return result(ctype, true)
+		return typeRefExpr(expr)
 	}
+	return nil, fmt.Errorf("%T: not a type name or TypeRef", t)
+}
 
-	return result(mapGoToCpp(goType))
+// parseTypeExpr parses a Go type, as a string.
+func parseTypeExpr(t string) (ast.Expr, error) {
+	expr, err := parser.ParseExpr(t)
+	if err != nil {
+		return nil, fmt.Errorf("malformed type %q: %v", t, err)
+	}
+	return expr, nil
 }
 
-func cppType(t string) string {
-	c := cpptype(t, false)
-	logdebug("cpptype %q -> %q", t, c)
-	return c
+// typeRefExpr returns a TypeRef describing the type expression expr.
+// Without type information the names of types declared in other
+// packages are left qualified, e.g. common.Timestamp, and the names of
+// type parameters are described as named types.
+func typeRefExpr(expr ast.Expr) (*TypeRef, error) {
+	ref := &TypeRef{}
+	var err error
+	switch expr := expr.(type) {
+	case *ast.ParenExpr:
+		return typeRefExpr(expr.X)
+	case *ast.Ident:
+		ref.Kind, ref.Name = TypeKindNamed, expr.Name
+		if _, ok := types.Universe.Lookup(expr.Name).(*types.TypeName); ok {
+			ref.Kind = TypeKindBasic
+		}
+	case *ast.SelectorExpr:
+		ref.Kind, ref.Name = TypeKindNamed, types.ExprString(expr)
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		x, indices := typeparams(expr)
+		if ref, err = typeRefExpr(x); err != nil {
+			return nil, err
+		}
+		if ref.Kind != TypeKindNamed {
+			return nil, fmt.Errorf("%s: type arguments of a type that is not generic", types.ExprString(expr))
+		}
+		for i := 0; i < len(indices) && err == nil; i++ {
+			var arg *TypeRef
+			arg, err = typeRefExpr(indices[i])
+			ref.Args = append(ref.Args, arg)
+		}
+	case *ast.StarExpr:
+		ref.Kind = TypeKindOptional
+		ref.Elem, err = typeRefExpr(expr.X)
+	case *ast.ArrayType:
+		ref.Kind = TypeKindSlice
+		if expr.Len != nil {
+			ref.Kind, ref.LengthExpr = TypeKindArray, types.ExprString(expr.Len)
+			ref.Len, _ = strconv.Atoi(ref.LengthExpr)
+		}
+		ref.Elem, err = typeRefExpr(expr.Elt)
+	case *ast.MapType:
+		ref.Kind = TypeKindMap
+		if ref.Key, err = typeRefExpr(expr.Key); err == nil {
+			ref.Elem, err = typeRefExpr(expr.Value)
+		}
+	case *ast.StructType:
+		if expr.Fields.NumFields() != 0 {
+			return nil, fmt.Errorf("%s: anonymous struct types are not supported", types.ExprString(expr))
+		}
+		ref.Kind = TypeKindStruct
+	default:
+		return nil, fmt.Errorf("%s: not a supported type", types.ExprString(expr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
 }
 
-func argType(t string) string {
-	c := cpptype(t, true)
-	logdebug("argtype %q -> %q", t, c)
-	return c
+// typeparams returns the generic type and type arguments of an
+// instantiation, an *ast.IndexExpr or *ast.IndexListExpr.
+func typeparams(expr ast.Expr) (ast.Expr, []ast.Expr) {
+	if index, ok := expr.(*ast.IndexExpr); ok {
+		return index.X, []ast.Expr{index.Index}
+	}
+	list := expr.(*ast.IndexListExpr)
+	return list.X, list.Indices
 }
 
-func resType(t string) string {
-	c := cpptype(t, false)
+func resType(t interface{}) (string, error) {
+	c, err := mapType(t, false)
 	if strings.HasSuffix(c, " *") {
 		c = strings.TrimSuffix(c, " *")
 		c = fmt.Sprintf("std::vector<%s>", c)
 	}
-	logdebug("restype %q -> %q", t, c)
-	return c
+	logdebug("restype %v -> %q", t, c)
+	return c, err
 }
 
 func basename(path string) string {
@@ -102,38 +197,65 @@ func basename(path string) string {
 	return base
 }
 
+// errResult returns the C++ result type of a method returning an error
+// and values of the C++ type t, as per the error-result type mapping.
+func errResult(t string) string {
+	c := mapErrorResultToCpp(t)
+	logdebug("errresult %q -> %q", t, c)
+	return c
+}
+
 func tolower(s string) string {
 	return strings.ToLower(s)
 }
 
-func eltype(t string) string {
-	if t[0] != '[' {
-		return t
+// eltype returns the element type of an array or slice type, or the
+// type itself if it is neither. A type given as a string results in a
+// string.
+func eltype(t interface{}) (interface{}, error) {
+	if name, ok := t.(string); ok {
+		expr, err := parseTypeExpr(name)
+		if err != nil {
+			return nil, err
+		}
+		if array, ok := expr.(*ast.ArrayType); ok {
+			logdebug("eltype %q -> %q", name, types.ExprString(array.Elt))
+			return types.ExprString(array.Elt), nil
+		}
+		return name, nil
+	}
+	ref, err := toTypeRef(t)
+	if err != nil {
+		return nil, err
 	}
-	end := strings.Index(t, "]")
-	if end == -1 {
-		panic("malformed type: " + t)
+	if ref.Kind != TypeKindArray && ref.Kind != TypeKindSlice {
+		return ref, nil
 	}
-	et := t[end+1:]
-	logdebug("eltype %q -> %q", t, et)
-	return et
+	return ref.Elem, nil
 }
 
-func dims(t string) string {
-	if t[0] != '[' {
-		return ""
+// dims returns the dimension of an array or slice type, [N] or [], or
+// an empty string if it is neither.
+func dims(t interface{}) (string, error) {
+	ref, err := toTypeRef(t)
+	if err != nil {
+		return "", err
 	}
-	end := strings.Index(t, "]")
-	if end == -1 {
-		panic("malformed type: " + t)
+	switch ref.Kind {
+	case TypeKindArray:
+		return "[" + ref.LengthExpr + "]", nil
+	case TypeKindSlice:
+		return "[]", nil
 	}
-	d := t[0 : end+1]
-	logdebug("dims %q -> %q", t, d)
-	return d
+	return "", nil
 }
 
-func isslice(t string) bool {
-	return strings.HasPrefix(t, "[]")
+func isslice(t interface{}) (bool, error) {
+	ref, err := toTypeRef(t)
+	if err != nil {
+		return false, err
+	}
+	return ref.Kind == TypeKindSlice, nil
 }
 
 func decap(s string) string {
@@ -172,7 +294,12 @@ func divide(a, b int) int {
 	return a / b
 }
 
+// sizeof returns the size of t, or zero if its size depends on type
+// parameters.
 func sizeof(t types.Type) int {
+	if !hasLayout(t) {
+		return 0
+	}
 	return int(Sizer.Sizeof(t))
 }
 
@@ -190,6 +317,7 @@ var cppTemplateFuncs = map[string]interface{}{
 	"cpptype":    cppType,
 	"dims":       dims,
 	"eltype":     eltype,
+	"errresult":  errResult,
 	"isslice":    isslice,
 	"add":        add,
 	"subtract":   subtract,
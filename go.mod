@@ -1,3 +1,3 @@
 module github.com/atrn/ridl
 
-go 1.16
+go 1.22
@@ -0,0 +1,255 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/constant"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Interfaces and methods have IDs that remain the same as a package
+// changes so peers built from different versions of a package agree
+// on interface and message codes. An ID is given by an "//ridl:id"
+// annotation or, if not annotated, derived from a hash of the name.
+// Once assigned, IDs are recorded in the package's lock file, see
+// lockFilename, and used by later runs. IDs of declarations that are
+// removed are retired and are not assigned again, other than to a
+// declaration of the same name. The package's PackageID constant is
+// also recorded and may not change.
+//
+// Interface IDs are in the range [1, MaxInterfaceID] and method IDs,
+// unique within the package, in [1, MaxMethodID]. A method's request
+// message has the ID 2*ID and its response 2*ID+1.
+
+// LockFilename is the name of the file recording the IDs of a package
+// made up of all of the .ridl files in its directory.
+const LockFilename = "ridl.lock"
+
+const (
+	// MaxInterfaceID is the largest interface ID.
+	MaxInterfaceID = 0xffff
+	// MaxMethodID is the largest method ID, leaving room for the
+	// direction bit of a message ID in 16 bits.
+	MaxMethodID = 0x7fff
+)
+
+// An idTable maps names to IDs. Methods are named by their
+// interface's name and their own, e.g. "Service.Hello".
+type idTable struct {
+	Interfaces map[string]int `json:"interfaces,omitempty"`
+	Methods    map[string]int `json:"methods,omitempty"`
+}
+
+// An IDLock is the content of a lock file, the IDs assigned to a
+// package's interfaces and methods and those retired.
+type IDLock struct {
+	PackageID *uint32 `json:"packageID,omitempty"`
+	IDs       idTable `json:"ids"`
+	Retired   idTable `json:"retired"`
+	filename  string
+}
+
+func newIDLock(filename string) *IDLock {
+	return &IDLock{
+		IDs:      idTable{make(map[string]int), make(map[string]int)},
+		Retired:  idTable{make(map[string]int), make(map[string]int)},
+		filename: filename,
+	}
+}
+
+// lockFilename returns the name of the lock file of the package made
+// up of the named files. A package made up of all of the .ridl files
+// in its directory uses the directory's LockFilename. Other packages,
+// i.e. single files named on the command line, use a lock file named
+// after the file, e.g. "one.ridl.lock", so packages sharing a
+// directory do not share a lock.
+func lockFilename(filenames []string) string {
+	directory := filepath.Dir(filenames[0])
+	if len(filenames) == 1 && len(ridlFiles(directory)) > 1 {
+		return filenames[0] + ".lock"
+	}
+	return filepath.Join(directory, LockFilename)
+}
+
+// readLock reads the named lock file. It returns an empty IDLock if
+// there is no such file.
+func readLock(filename string) (*IDLock, error) {
+	lock := newIDLock(filename)
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for _, m := range []*map[string]int{&lock.IDs.Interfaces, &lock.IDs.Methods, &lock.Retired.Interfaces, &lock.Retired.Methods} {
+		if *m == nil {
+			*m = make(map[string]int)
+		}
+	}
+	return lock, nil
+}
+
+// write writes the lock file if its content has changed. A lock
+// recording nothing is not written.
+func (lock *IDLock) write() error {
+	if lock.PackageID == nil && len(lock.IDs.Interfaces) == 0 && len(lock.IDs.Methods) == 0 &&
+		len(lock.Retired.Interfaces) == 0 && len(lock.Retired.Methods) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if existing, err := os.ReadFile(lock.filename); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	logdebug("writing %q", lock.filename)
+	return os.WriteFile(lock.filename, data, 0o644)
+}
+
+//  ================================================================
+
+// packageID returns the value of the package's PackageID constant, and
+// its declaration, or nil if it declares no such integer constant.
+func (p *Package) packageID() (uint32, *ConstDecl) {
+	for _, d := range p.Decls {
+		if c, ok := d.(*ConstDecl); ok && c.Name() == "PackageID" {
+			if id, exact := constant.Uint64Val(constant.ToInt(c.Value())); exact {
+				return uint32(id), c
+			}
+		}
+	}
+	return 0, nil
+}
+
+// assignIDs assigns IDs to the receiver's interfaces and methods using,
+// and updating, the IDs recorded in lock. It returns a Diagnostic for
+// each annotated ID that is out of range, duplicated, retired or
+// differs from the recorded ID, and if the PackageID has changed.
+func (p *Package) assignIDs(lock *IDLock) Diagnostics {
+	var diagnostics Diagnostics
+	errorf := func(d Decl, format string, args ...interface{}) {
+		diagnostics = append(diagnostics, Diagnostic{d.Position(), fmt.Sprintf(format, args...)})
+	}
+	if id, decl := p.packageID(); decl != nil {
+		if lock.PackageID != nil && *lock.PackageID != id {
+			errorf(decl, "PackageID %#x differs from %#x, recorded in %s", id, *lock.PackageID, filepath.Base(lock.filename))
+		}
+		lock.PackageID = &id
+	}
+	var interfaces, methods []idUser
+	for _, d := range p.Decls {
+		intf, ok := d.(*InterfaceDecl)
+		if !ok {
+			continue
+		}
+		interfaces = append(interfaces, idUser{intf, intf.Name(), &intf.ID})
+		for _, m := range intf.OwnMethods {
+			methods = append(methods, idUser{m, intf.Name() + "." + m.Name(), &m.ID})
+		}
+	}
+	lockName := filepath.Base(lock.filename)
+	assignIDs("interface", interfaces, lock.IDs.Interfaces, lock.Retired.Interfaces, MaxInterfaceID, lockName, errorf)
+	assignIDs("method", methods, lock.IDs.Methods, lock.Retired.Methods, MaxMethodID, lockName, errorf)
+	diagnostics.Sort()
+	return diagnostics
+}
+
+// An idUser is a declaration assigned an ID.
+type idUser struct {
+	decl Decl
+	name string
+	id   *int
+}
+
+// assignIDs assigns IDs, in the range [1, max], to users. Recorded IDs
+// are assigned first, then annotated IDs and then those derived from
+// the users' names. IDs recorded for names that are not used are
+// retired. Diagnostics refer to the lock file by lockName.
+func assignIDs(what string, users []idUser, ids, retired map[string]int, max int, lockName string, errorf func(Decl, string, ...interface{})) {
+	owner := make(map[int]string)
+	for name, id := range retired {
+		owner[id] = name
+	}
+	present := make(map[string]bool)
+	var annotated, hashed []idUser
+	for _, u := range users {
+		present[u.name] = true
+		annotation, isAnnotated := u.decl.(interface{ Annotation(string) interface{} }).Annotation("id").(int)
+		if id, found := ids[u.name]; found {
+			if isAnnotated && annotation != id {
+				errorf(u.decl, "%s %s: id %d differs from id %d, recorded in %s", what, u.name, annotation, id, lockName)
+			}
+			if previous, used := owner[id]; used {
+				errorf(u.decl, "%s %s: id %d, recorded in %s, is also used by %s", what, u.name, id, lockName, previous)
+			}
+			*u.id = id
+			owner[id] = u.name
+		} else if isAnnotated {
+			*u.id = annotation
+			annotated = append(annotated, u)
+		} else {
+			hashed = append(hashed, u)
+		}
+	}
+	for _, u := range annotated {
+		previous, used := owner[*u.id]
+		_, isRetired := retired[previous]
+		switch {
+		case *u.id < 1 || *u.id > max:
+			errorf(u.decl, "%s %s: id %d is not in the range [1, %d]", what, u.name, *u.id, max)
+		case used && isRetired && previous != u.name:
+			errorf(u.decl, "%s %s: id %d was used by %s, which has been removed", what, u.name, *u.id, previous)
+		case used && previous != u.name:
+			errorf(u.decl, "%s %s: id %d is also used by %s", what, u.name, *u.id, previous)
+		default:
+			owner[*u.id] = u.name
+			ids[u.name] = *u.id
+			delete(retired, u.name)
+		}
+	}
+	for _, u := range hashed {
+		id, found := retired[u.name]
+		if found {
+			delete(retired, u.name)
+		} else {
+			id = hashID(u.name, max)
+			for _, used := owner[id]; used; _, used = owner[id] {
+				id = id%max + 1
+			}
+		}
+		*u.id = id
+		owner[id] = u.name
+		ids[u.name] = id
+	}
+	for name, id := range ids {
+		if !present[name] {
+			delete(ids, name)
+			retired[name] = id
+		}
+	}
+}
+
+// hashID returns an ID, in the range [1, max], derived from name.
+func hashID(name string, max int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%uint32(max)) + 1
+}
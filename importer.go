@@ -0,0 +1,269 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A ridlImporter is a types.Importer that imports packages of .ridl
+// files. An import path is resolved against each directory of the
+// search path in turn and the first directory containing .ridl files
+// is used. Paths that do not resolve are imported as Go packages.
+//
+// Imported packages are type-checked, using the same importer, and
+// cached so each is loaded only once.
+type ridlImporter struct {
+	fset        *token.FileSet
+	searchPath  []string
+	fallback    types.Importer
+	packages    map[string]*Package
+	importing   map[string]bool
+	packageIDs  map[uint32]*Package
+	diagnostics Diagnostics
+}
+
+func newRidlImporter(fset *token.FileSet, searchPath []string) *ridlImporter {
+	return &ridlImporter{
+		fset:       fset,
+		searchPath: searchPath,
+		fallback:   importer.Default(),
+		packages:   make(map[string]*Package),
+		importing:  make(map[string]bool),
+		packageIDs: make(map[uint32]*Package),
+	}
+}
+
+// importSearchPath returns the directories searched for imported
+// packages, those named by -I options followed by those in RIDLPATH.
+func importSearchPath() []string {
+	searchPath := append([]string(nil), importDirs.Slice()...)
+	if s := os.Getenv("RIDLPATH"); s != "" {
+		searchPath = append(searchPath, filepath.SplitList(s)...)
+	}
+	return searchPath
+}
+
+// Import implements types.Importer.
+func (imp *ridlImporter) Import(path string) (*types.Package, error) {
+	if p, found := imp.packages[path]; found {
+		return p.types, nil
+	}
+	directory, filenames := imp.find(path)
+	if filenames == nil {
+		return imp.fallback.Import(path)
+	}
+	if imp.importing[path] {
+		return nil, fmt.Errorf("import cycle through %q", path)
+	}
+	imp.importing[path] = true
+	defer delete(imp.importing, path)
+	logdebug("importing %q from %q", path, directory)
+	p, err := imp.check(path, filenames)
+	if err != nil {
+		var diagnostics Diagnostics
+		if errors.As(err, &diagnostics) {
+			imp.diagnostics = append(imp.diagnostics, diagnostics...)
+			return nil, fmt.Errorf("%s: %d errors", directory, len(diagnostics))
+		}
+		return nil, err
+	}
+	imp.packages[path] = p
+	return p.types, nil
+}
+
+// writeLocks writes the lock files of the packages loaded, those in
+// loaded and the ridl packages they import.
+func writeLocks(loaded []*Package) error {
+	seen := make(map[*Package]bool)
+	var write func(p *Package) error
+	write = func(p *Package) error {
+		if seen[p] || p.lock == nil {
+			return nil
+		}
+		seen[p] = true
+		for _, imported := range p.ImportedPackages {
+			if err := write(imported); err != nil {
+				return err
+			}
+		}
+		return p.lock.write()
+	}
+	for _, p := range loaded {
+		if err := write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load returns the package made up of the named files in directory.
+// A directory found on the search path is loaded under its import
+// path, so packages importing it share the one Package.
+func (imp *ridlImporter) load(directory string, filenames []string) (*Package, error) {
+	path := imp.importPath(directory)
+	if path == "" {
+		return imp.check("", filenames)
+	}
+	if p, found := imp.packages[path]; found {
+		return p, nil
+	}
+	p, err := imp.check(path, filenames)
+	if err == nil {
+		imp.packages[path] = p
+	}
+	return p, err
+}
+
+// importPath returns the path by which the package in directory is
+// imported, or "" if it cannot be imported from the search path.
+func (imp *ridlImporter) importPath(directory string) string {
+	abs, err := filepath.Abs(directory)
+	if err != nil {
+		return ""
+	}
+	for _, dir := range imp.searchPath {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		path := filepath.ToSlash(rel)
+		if found, _ := imp.find(path); found != "" && sameDir(found, abs) {
+			return path
+		}
+		return ""
+	}
+	return ""
+}
+
+// sameDir reports whether the named directories are the same.
+func sameDir(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// find returns the directory, and the names of the .ridl files within
+// it, of the package with the given import path.
+func (imp *ridlImporter) find(path string) (string, []string) {
+	for _, dir := range imp.searchPath {
+		directory := filepath.Join(dir, filepath.FromSlash(path))
+		if filenames, _ := filepath.Glob(filepath.Join(directory, "*.ridl")); filenames != nil {
+			return directory, filenames
+		}
+	}
+	return "", nil
+}
+
+// checkPackageID returns a Diagnostic if the package's PackageID is
+// that of another package loaded by the importer.
+func (imp *ridlImporter) checkPackageID(p *Package) Diagnostics {
+	id, decl := p.packageID()
+	if decl == nil {
+		return nil
+	}
+	if other, found := imp.packageIDs[id]; found {
+		_, otherDecl := other.packageID()
+		return Diagnostics{{decl.Position(), fmt.Sprintf("PackageID %#x is also declared by package %s at %s", id, other.PackageName, otherDecl.Position())}}
+	}
+	imp.packageIDs[id] = p
+	return nil
+}
+
+// check parses and type-checks the named files as the package with
+// the given import path and returns its Package model. Type-checking
+// and validation errors are returned as Diagnostics.
+func (imp *ridlImporter) check(path string, filenames []string) (*Package, error) {
+	files := make([]*ast.File, 0, len(filenames))
+	for _, filename := range filenames {
+		logdebug("ParseFile %q", filename)
+		file, err := parser.ParseFile(imp.fset, filename, nil, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("parse %q: %w", filename, err)
+		}
+		files = append(files, file)
+	}
+	var diagnostics Diagnostics
+	conf := types.Config{
+		IgnoreFuncBodies:         true,
+		Importer:                 imp,
+		DisableUnusedImportCheck: true,
+		Error: func(err error) {
+			if e, ok := err.(types.Error); ok {
+				diagnostics = append(diagnostics, Diagnostic{e.Fset.Position(e.Pos), e.Msg})
+			}
+		},
+	}
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	pkg, err := conf.Check(path, imp.fset, files, info)
+	if len(diagnostics) != 0 {
+		return nil, diagnostics
+	}
+	if err != nil {
+		return nil, fmt.Errorf("type check %q: %w", filenames, err)
+	}
+	values, diagnostics := collectValues(imp.fset, files, info)
+	diagnostics = append(diagnostics, validatePackage(pkg, imp.fset, values)...)
+	diagnostics.Sort()
+	if len(diagnostics) != 0 && !*permissiveFlag {
+		return nil, diagnostics
+	}
+	p := NewPackage(pkg, imp.fset, values)
+	for _, s := range p.Skipped {
+		log.Printf("%s: warning: %s skipped: %s", s.Position, s.What, s.Reason)
+	}
+	p.arrayLengths = collectArrayLengths(files, info)
+	p.synthesizeStructs(structPositions(files, info))
+	p.findInstances()
+	if len(p.diagnostics) != 0 {
+		p.diagnostics.Sort()
+		return nil, p.diagnostics
+	}
+	p.comments = collectComments(imp.fset, files)
+	p.derivations = collectDerivations(files, info)
+	p.shifts = collectShifts(files, info)
+	if diagnostics := p.annotate(); len(diagnostics) != 0 {
+		return nil, diagnostics
+	}
+	if len(filenames) != 0 {
+		if p.lock, err = readLock(lockFilename(filenames)); err != nil {
+			return nil, err
+		}
+		if diagnostics := p.assignIDs(p.lock); len(diagnostics) != 0 {
+			return nil, diagnostics
+		}
+	}
+	if diagnostics := imp.checkPackageID(p); len(diagnostics) != 0 {
+		return nil, diagnostics
+	}
+	p.orderDecls()
+	for _, path := range p.Imports {
+		if imported, found := imp.packages[path]; found {
+			p.ImportedPackages = append(p.ImportedPackages, imported)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportRidlPackage(t *testing.T) {
+	root := t.TempDir()
+	writeSources(t, root, map[string]string{"proto/common/common.ridl": `package common
+
+type Timestamp struct {
+	Secs  uint64
+	Nanos uint32
+}
+`})
+
+	*importDirs = StringSlice{root}
+	defer func() { *importDirs = StringSlice{} }()
+
+	pkg := parseSource(t, `package test
+
+import "proto/common"
+
+type Event struct {
+	common.Timestamp
+	When common.Timestamp
+	Log  []common.Timestamp
+}
+`)
+	if len(pkg.ImportedPackages) != 1 {
+		t.Fatalf("%d imported packages, expected 1", len(pkg.ImportedPackages))
+	}
+	imported := pkg.ImportedPackages[0]
+	if imported.PackageName != "common" || imported.PackagePath != "proto/common" {
+		t.Fatalf("imported package %q (%q)", imported.PackageName, imported.PackagePath)
+	}
+
+	event := findDecl(t, pkg, "Event").(*StructDecl)
+	if event.Fields[0].Embedded() != findDecl(t, imported, "Timestamp") {
+		t.Errorf("embedded common.Timestamp not linked to its StructDecl")
+	}
+	if name := event.Fields[1].TypeName(); name != "common.Timestamp" {
+		t.Errorf("Event.When has type %q", name)
+	}
+	initTypeMap()
+	if cpp := mustMap(t, cppType, event.Fields[2].TypeName()); cpp != "std::vector<common::Timestamp>" {
+		t.Errorf("Event.Log has C++ type %q", cpp)
+	}
+}
+
+func TestPackagePatterns(t *testing.T) {
+	root := t.TempDir()
+	sources := map[string]string{
+		"proto/app/app.ridl": `package app
+
+import "proto/common"
+
+type Request struct {
+	ID common.ID
+}
+`,
+		"proto/common/common.ridl": "package common\n\ntype ID uint64\n",
+		"proto/testdata/bad.ridl":  "package bad\n\nvar X int\n",
+		"proto/.hidden/bad.ridl":   "package bad\n\nvar X int\n",
+	}
+	writeSources(t, root, sources)
+
+	units, err := findUnits([]string{filepath.Join(root, "proto") + "/..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 2 {
+		t.Fatalf("%d units, expected 2", len(units))
+	}
+
+	*importDirs = StringSlice{root}
+	defer func() { *importDirs = StringSlice{} }()
+	imp := newRidlImporter(token.NewFileSet(), importSearchPath())
+	for _, u := range units {
+		if u.pkg, err = imp.load(u.directory, u.filenames); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ordered := dependencyOrder(units)
+	if ordered[0].pkg.PackageName != "common" || ordered[1].pkg.PackageName != "app" {
+		t.Errorf("packages ordered %s, %s", ordered[0].pkg.PackageName, ordered[1].pkg.PackageName)
+	}
+	if ordered[1].pkg.ImportedPackages[0] != ordered[0].pkg {
+		t.Errorf("proto/common loaded more than once")
+	}
+}
+
+func TestStableIDs(t *testing.T) {
+	dir := t.TempDir()
+	load := func(source string) (*Package, error) {
+		t.Helper()
+		writeSources(t, dir, map[string]string{"test.ridl": source})
+		pkg, err := checkFiles([]string{filepath.Join(dir, "test.ridl")})
+		if err == nil {
+			err = pkg.lock.write()
+		}
+		return pkg, err
+	}
+	methodIDs := func(pkg *Package) map[string]int {
+		service := findDecl(t, pkg, "Service").(*InterfaceDecl)
+		ids := map[string]int{"Service": service.ID}
+		for _, m := range service.OwnMethods {
+			ids[m.Name()] = m.ID
+		}
+		return ids
+	}
+
+	pkg, err := load(`package test
+
+const PackageID = 7
+
+type Service interface {
+	Hello()
+	//ridl:id 100
+	Reset()
+	Goodbye()
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := methodIDs(pkg)
+	if first["Reset"] != 100 || first["Hello"] == first["Goodbye"] || first["Service"] == 0 {
+		t.Fatalf("method IDs %v", first)
+	}
+
+	// Inserting and removing methods leaves the others' IDs unchanged.
+	pkg, err = load(`package test
+
+const PackageID = 7
+
+type Service interface {
+	Hello()
+	Ping()
+	Reset()
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := methodIDs(pkg)
+	if second["Hello"] != first["Hello"] || second["Reset"] != 100 || second["Service"] != first["Service"] {
+		t.Errorf("method IDs changed from %v to %v", first, second)
+	}
+	if pkg.lock.Retired.Methods["Service.Goodbye"] != first["Goodbye"] {
+		t.Errorf("Service.Goodbye not retired: %v", pkg.lock.Retired.Methods)
+	}
+
+	for _, test := range []struct {
+		source, expected string
+	}{
+		{"//ridl:id 100\n\tStop()", "id 100 is also used by Service.Reset"},
+		{fmt.Sprintf("//ridl:id %d\n\tStop()", first["Goodbye"]), "which has been removed"},
+		{"//ridl:id 99999\n\tStop()", "not in the range"},
+	} {
+		_, err := load("package test\n\nconst PackageID = 7\n\ntype Service interface {\n\tHello()\n\tPing()\n\tReset()\n\t" + test.source + "\n}\n")
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%q: error %v, expected %q", test.source, err, test.expected)
+		}
+	}
+	if _, err := load("package test\n\nconst PackageID = 8\n"); err == nil || !strings.Contains(err.Error(), "PackageID 0x8 differs from 0x7") {
+		t.Errorf("changed PackageID: error %v", err)
+	}
+}
+
+func TestDuplicatePackageIDs(t *testing.T) {
+	root := t.TempDir()
+	writeSources(t, root, map[string]string{
+		"a/a.ridl": "package a\n\nconst PackageID = 42\n",
+		"b/b.ridl": "package b\n\nconst PackageID = 42\n",
+	})
+	*dryRunFlag = true
+	defer func() { *dryRunFlag = false }()
+	err := ridl([]string{filepath.Join(root, "...")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "PackageID 0x2a is also declared by package a") {
+		t.Errorf("duplicate PackageIDs: error %v", err)
+	}
+}
+
+func TestImportedPackageLocks(t *testing.T) {
+	root := t.TempDir()
+	sources := map[string]string{
+		"app/app.ridl": `package app
+
+import "proto/common"
+
+type Service interface {
+	Now() common.Time
+}
+`,
+		"proto/common/common.ridl": `package common
+
+type Time uint64
+
+type Clock interface {
+	Now() Time
+}
+`,
+	}
+	writeSources(t, root, sources)
+	*importDirs = StringSlice{root}
+	defer func() { *importDirs = StringSlice{} }()
+	if err := ridl([]string{filepath.Join(root, "app")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"app", "proto/common"} {
+		lock, err := readLock(filepath.Join(root, filepath.FromSlash(dir), LockFilename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lock.IDs.Interfaces) != 1 || len(lock.IDs.Methods) != 1 {
+			t.Errorf("%s: lock records interfaces %v and methods %v", dir, lock.IDs.Interfaces, lock.IDs.Methods)
+		}
+	}
+}
+
+func TestSingleFileLocks(t *testing.T) {
+	root := t.TempDir()
+	writeSources(t, root, map[string]string{
+		"one.ridl": "package one\n\nconst PackageID = 1\n\ntype One interface {\n\tHello()\n}\n",
+		"two.ridl": "package two\n\nconst PackageID = 2\n",
+	})
+	for _, name := range []string{"one.ridl", "two.ridl", "one.ridl"} {
+		if err := ridl([]string{filepath.Join(root, name)}, nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	for name, id := range map[string]uint32{"one.ridl": 1, "two.ridl": 2} {
+		lock, err := readLock(filepath.Join(root, name+".lock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lock.PackageID == nil || *lock.PackageID != id {
+			t.Errorf("%s: lock records PackageID %v", name, lock.PackageID)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, LockFilename)); err == nil {
+		t.Errorf("single file packages wrote %s", LockFilename)
+	}
+}
@@ -8,6 +8,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -20,11 +21,16 @@ const (
 )
 
 var (
-	templateNames  = NewStringSlice()
-	templateDirs   = NewStringSlice()
-	outputFilename = flag.String("o", "", "write output to `filename` (use '-' for stdout)")
-	debugFlag      = flag.Bool("debug", false, "enable debug output")
-	dryRunFlag     = flag.Bool("n", false, "do not generate output, only parse files")
+	templateNames    = NewStringSlice()
+	templateDirs     = NewStringSlice()
+	importDirs       = NewStringSlice()
+	outputFilename   = flag.String("o", "", "write output to `filename` (use '-' for stdout)")
+	debugFlag        = flag.Bool("debug", false, "enable debug output")
+	dryRunFlag       = flag.Bool("n", false, "do not generate output, only parse files")
+	archFlag         = flag.String("arch", "amd64", "compute layouts for target `arch`, [compiler/]GOARCH")
+	packedFlag       = flag.Bool("packed", false, "compute layouts without padding")
+	fingerprintsFlag = flag.Bool("fingerprints", false, "print the fingerprints of each package's types, interfaces and messages")
+	permissiveFlag   = flag.Bool("permissive", false, "accept .go files, skipping declarations not permitted in ridl files")
 )
 
 func main() {
@@ -34,13 +40,14 @@ func main() {
 	log.SetPrefix(myname + ": ")
 
 	flag.Usage = func() {
-		fmt.Fprintln(os.Stderr, "usage:", myname, "[options] path")
+		fmt.Fprintln(os.Stderr, "usage:", myname, "[options] path...")
 		flag.PrintDefaults()
 	}
 
 	versionFlag := flag.Bool("version", false, "output version and exit")
 	flag.Var(templateNames, "t", "generate output using `template`")
 	flag.Var(templateDirs, "T", "search for templates in `dir`")
+	flag.Var(importDirs, "I", "search for imported packages in `dir`")
 	typeMapFlag := flag.String("typemap", "", "type mapping `filename`")
 	writeTypeMapFlag := flag.Bool("write-typemap", false, "output type mapping JSON and exit")
 
@@ -55,6 +62,10 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := SetABI(*archFlag, *packedFlag); err != nil {
+		log.Fatal(err)
+	}
+
 	initTypeMap()
 
 	if *typeMapFlag != "" {
@@ -73,17 +84,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	for _, path := range flag.Args() {
-		var err error
-		if isDir(path) {
-			err = ridlDir(path, templateNames.Slice())
-		} else {
-			err = ridlFile(path, templateNames.Slice())
-		}
-		if err != nil {
-			log.Fatal(err)
-		}
+	if err := ridl(flag.Args(), templateNames.Slice()); err != nil {
+		fatal(err)
+	}
+}
+
+// fatal reports an error and exits. Diagnostics are reported one per
+// line, followed by their count.
+func fatal(err error) {
+	var diagnostics Diagnostics
+	if !errors.As(err, &diagnostics) {
+		log.Fatal(err)
+	}
+	for _, d := range diagnostics {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	if len(diagnostics) == 1 {
+		log.Fatal("1 error")
 	}
+	log.Fatalf("%d errors", len(diagnostics))
 }
 
 func isDir(path string) bool {
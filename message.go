@@ -0,0 +1,116 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+)
+
+// MessageDirection is the direction of a Message, a request from
+// client to server or a response from server to client.
+type MessageDirection int
+
+const (
+	// MessageRequest is a request, a method's arguments.
+	MessageRequest MessageDirection = iota
+	// MessageResponse is a response, a method's results.
+	MessageResponse
+)
+
+func (d MessageDirection) String() string {
+	switch d {
+	case MessageRequest:
+		return "request"
+	case MessageResponse:
+		return "response"
+	}
+	panic(fmt.Errorf("bad MessageDirection value == %d", int(d)))
+}
+
+//  ================================================================
+
+// A Message is a request or response exchanged when calling an
+// interface method. Each method declared by the package's interfaces
+// has a request, holding its arguments, and, unless it is annotated
+// oneway, a response, holding its value results. A method's error result is not a field of its
+// response, whose HasError is set so transports carry the error as a
+// status.
+//
+// Messages are in the order of the package's interfaces and their
+// methods, each method's request followed by its response. A message's
+// ID is derived from its method's stable ID, see assignIDs, 2*ID for
+// the request and 2*ID+1 for the response. Its Code is the ID combined
+// with the package's PackageID constant, if declared, as
+// PackageID<<16 | ID.
+type Message struct {
+	Name      string
+	Direction MessageDirection
+	Interface *InterfaceDecl
+	Method    *MethodDecl
+	Fields    []*MethodArg
+	ID        int
+	Code      uint32
+}
+
+// IsRequest returns true if the message is a method's request.
+func (m *Message) IsRequest() bool {
+	return m.Direction == MessageRequest
+}
+
+// IsResponse returns true if the message is a method's response.
+func (m *Message) IsResponse() bool {
+	return m.Direction == MessageResponse
+}
+
+// HasError returns true if the message is the response of a method
+// with an error result.
+func (m *Message) HasError() bool {
+	return m.IsResponse() && m.Method.HasError()
+}
+
+// Peer returns the other message of the receiver's method, the
+// response to a request or the request for a response. The request of
+// a oneway method has no peer.
+func (m *Message) Peer() *Message {
+	if m.IsRequest() {
+		return m.Method.Response
+	}
+	return m.Method.Request
+}
+
+// findMessages synthesizes the request and response Messages of the
+// methods declared by the context's interfaces.
+func (c *Context) findMessages() {
+	packageID, _ := c.Package.packageID()
+	add := func(intf *InterfaceDecl, method *MethodDecl, direction MessageDirection, fields []*MethodArg) *Message {
+		id := method.ID<<1 | int(direction)
+		suffix := "Request"
+		if direction == MessageResponse {
+			suffix = "Response"
+		}
+		m := &Message{
+			Name:      fmt.Sprintf("%s_%s_%s", intf.Name(), method.Name(), suffix),
+			Direction: direction,
+			Interface: intf,
+			Method:    method,
+			Fields:    fields,
+			ID:        id,
+			Code:      packageID<<16 | uint32(id),
+		}
+		c.Messages = append(c.Messages, m)
+		return m
+	}
+	for _, intf := range c.Interfaces {
+		for _, method := range intf.OwnMethods {
+			method.Request = add(intf, method, MessageRequest, method.Args)
+			if !method.HasAnnotation("oneway") {
+				method.Response = add(intf, method, MessageResponse, method.ValueResults())
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// Declarations are in source order but target languages, such as C++,
+// require types to be declared before they are used. orderDecls
+// computes an order in which every declaration follows the
+// declarations of the types it references.
+//
+// A declaration references a type directly, requiring the type to be
+// complete, when it holds a value of the type, e.g. as a field, array
+// element or the type it is derived from. References through a slice,
+// optional value or map, and by method arguments and results, are
+// indirect and only require the type to have been declared. Types that
+// reference each other form a cycle. Within a cycle the declarations
+// are ordered by their direct references and each declaration
+// referenced indirectly by one ahead of it needs a forward
+// declaration. A declaration referencing only itself is not a cycle.
+//
+// Optional values are pointers in Go and so are indirect references,
+// but their representation depends on the type map. The default,
+// C++'s std::optional, holds its value directly and requires it to be
+// complete. Packages with optional values of types on the same cycle,
+// or of the referencing struct itself, need an optional mapping that
+// holds its value indirectly, e.g. std::unique_ptr<%s>.
+
+// A dependency is a reference from one declaration to another.
+type dependency struct {
+	decl     Decl
+	indirect bool
+}
+
+// orderDecls computes the dependency order of the receiver's
+// declarations, its cycles and the declarations needing forward
+// declarations.
+func (p *Package) orderDecls() {
+	o := &orderer{
+		pkg:      p,
+		deps:     make(map[Decl][]dependency),
+		index:    make(map[Decl]int),
+		lowlink:  make(map[Decl]int),
+		onStack:  make(map[Decl]bool),
+		position: make(map[Decl]int),
+	}
+	for i, d := range p.Decls {
+		o.position[d] = i
+		o.deps[d] = o.dependencies(d)
+	}
+	for _, d := range p.Decls {
+		if _, visited := o.index[d]; !visited {
+			o.connect(d)
+		}
+	}
+	p.order = o.order
+	p.cycles = o.cycles
+	p.forwardDecls = o.forward
+	for _, cycle := range p.cycles {
+		names := make([]string, len(cycle))
+		for i, d := range cycle {
+			names[i] = d.Name()
+		}
+		logdebug("%s: dependency cycle: %s", p.PackageName, strings.Join(names, ", "))
+	}
+}
+
+// orderer finds the strongly connected components of the graph of
+// declarations using Tarjan's algorithm. Components are found after
+// those they reference, i.e. in dependency order.
+type orderer struct {
+	pkg      *Package
+	deps     map[Decl][]dependency
+	index    map[Decl]int
+	lowlink  map[Decl]int
+	onStack  map[Decl]bool
+	stack    []Decl
+	position map[Decl]int
+	order    []Decl
+	cycles   [][]Decl
+	forward  map[types.Object]bool
+}
+
+func (o *orderer) connect(d Decl) {
+	o.index[d] = len(o.index)
+	o.lowlink[d] = o.index[d]
+	o.stack = append(o.stack, d)
+	o.onStack[d] = true
+	for _, dep := range o.deps[d] {
+		if _, visited := o.index[dep.decl]; !visited {
+			o.connect(dep.decl)
+			o.lower(d, o.lowlink[dep.decl])
+		} else if o.onStack[dep.decl] {
+			o.lower(d, o.index[dep.decl])
+		}
+	}
+	if o.lowlink[d] != o.index[d] {
+		return
+	}
+	var component []Decl
+	for {
+		n := len(o.stack) - 1
+		member := o.stack[n]
+		o.stack = o.stack[:n]
+		o.onStack[member] = false
+		component = append(component, member)
+		if member == d {
+			break
+		}
+	}
+	if len(component) == 1 {
+		o.order = append(o.order, d)
+		return
+	}
+	cycle := o.orderCycle(component)
+	o.order = append(o.order, cycle...)
+	o.cycles = append(o.cycles, cycle)
+}
+
+func (o *orderer) lower(d Decl, n int) {
+	if n < o.lowlink[d] {
+		o.lowlink[d] = n
+	}
+}
+
+// orderCycle orders the declarations of a cycle so each follows those
+// it references directly, in source order where there is a choice,
+// and marks those referenced indirectly before they are declared.
+func (o *orderer) orderCycle(component []Decl) []Decl {
+	remaining := append([]Decl(nil), component...)
+	sort.Slice(remaining, func(i, j int) bool {
+		return o.position[remaining[i]] < o.position[remaining[j]]
+	})
+	ready := func(d Decl) bool {
+		for _, dep := range o.deps[d] {
+			if !dep.indirect && dep.decl != d && o.onCycle(dep.decl, remaining) {
+				return false
+			}
+		}
+		return true
+	}
+	var cycle []Decl
+	for len(remaining) != 0 {
+		// Direct references cannot form a cycle in a valid package
+		// but, should they, the first remaining declaration is placed.
+		next := 0
+		for i, d := range remaining {
+			if ready(d) {
+				next = i
+				break
+			}
+		}
+		d := remaining[next]
+		remaining = append(remaining[:next], remaining[next+1:]...)
+		cycle = append(cycle, d)
+		for _, dep := range o.deps[d] {
+			if o.onCycle(dep.decl, remaining) {
+				if o.forward == nil {
+					o.forward = make(map[types.Object]bool)
+				}
+				o.forward[declObject(dep.decl)] = true
+			}
+		}
+	}
+	return cycle
+}
+
+func (o *orderer) onCycle(d Decl, decls []Decl) bool {
+	for _, member := range decls {
+		if member == d {
+			return true
+		}
+	}
+	return false
+}
+
+// dependencies returns the declarations of the receiver's package
+// referenced by the declaration d.
+func (o *orderer) dependencies(d Decl) []dependency {
+	var deps []dependency
+	seen := make(map[dependency]bool)
+	add := func(t types.Type, indirect bool) {
+		o.walk(t, indirect, func(dep dependency) {
+			if !seen[dep] {
+				seen[dep] = true
+				deps = append(deps, dep)
+			}
+		})
+	}
+	switch d := d.(type) {
+	case *StructDecl:
+		if t, found := o.pkg.derivations[d.Object]; found {
+			if _, isStruct := t.(*types.Struct); !isStruct {
+				add(t, false)
+			}
+		}
+		for _, f := range d.Fields {
+			add(f.Object.Type(), false)
+		}
+	case *InterfaceDecl:
+		for _, embedded := range d.Embeds {
+			add(embedded.Object.Type(), false)
+		}
+		for _, m := range d.OwnMethods {
+			for _, arg := range append(m.Args[:len(m.Args):len(m.Args)], m.Results...) {
+				add(arg.Object.Type(), true)
+			}
+		}
+	case *TypedefDecl, *ArrayDecl, *MapDecl:
+		obj := declObject(d)
+		if t, found := o.pkg.derivations[obj]; found {
+			add(t, false)
+		} else {
+			add(obj.Type().Underlying(), false)
+		}
+	default:
+		add(declObject(d).Type(), false)
+	}
+	return deps
+}
+
+// walk calls fn for each declaration referenced by the type t.
+func (o *orderer) walk(t types.Type, indirect bool, fn func(dependency)) {
+	switch t := t.(type) {
+	case *types.Named:
+		if d := o.pkg.declIndex[t.Origin().Obj()]; d != nil {
+			fn(dependency{d, indirect})
+		}
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			o.walk(t.TypeArgs().At(i), indirect, fn)
+		}
+	case *types.Alias:
+		if d := o.pkg.declIndex[t.Obj()]; d != nil {
+			fn(dependency{d, indirect})
+		}
+	case *types.Struct:
+		if named, found := o.pkg.anonymous[t]; found {
+			o.walk(named, indirect, fn)
+			return
+		}
+		for i := 0; i < t.NumFields(); i++ {
+			o.walk(t.Field(i).Type(), indirect, fn)
+		}
+	case *types.Pointer:
+		o.walk(t.Elem(), true, fn)
+	case *types.Slice:
+		o.walk(t.Elem(), true, fn)
+	case *types.Map:
+		o.walk(t.Key(), true, fn)
+		o.walk(t.Elem(), true, fn)
+	case *types.Array:
+		o.walk(t.Elem(), indirect, fn)
+	}
+}
+
+// NeedsForwardDecl returns true if the declaration is on a dependency
+// cycle and is referenced, indirectly, ahead of its declaration.
+func (d *decl) NeedsForwardDecl() bool {
+	return d.pkg.forwardDecls[d.Object]
+}
@@ -1,32 +1,75 @@
 package main
 
 import (
+	"fmt"
 	"go/token"
 	"go/types"
 	"sort"
+	"strconv"
+	"strings"
 )
 
-var Sizer = types.SizesFor("gc", "amd64")
+// Sizer computes sizes, offsets and alignments for the target ABI
+// (see SetABI).
+var Sizer types.Sizes = types.SizesFor("gc", "amd64")
+
+// A SkippedDecl records a declaration that ridl does not support, or
+// that uses a type that ridl does not support, and which is not
+// included in a Package's declarations. What describes the
+// declaration, e.g. "type Record", and Reason why it was skipped.
+type SkippedDecl struct {
+	Position token.Position
+	What     string
+	Reason   string
+}
 
 // The Package type represents a single package, a named collection of
 // declarations, constants, types, and associated imported packages.
 //
-// Decls and Imports are in declaration order.
+// Decls and Imports are in declaration order. Skipped holds, in
+// declaration order, those declarations that were not added to Decls
+// as ridl does not support them, e.g. functions and variables.
+//
+// ImportedPackages holds the models of the imported ridl packages, in
+// import order. Imported Go packages have no model. Instances holds
+// the instantiations of generic types used by the declarations.
 type Package struct {
-	PackageName string
-	Decls       []Decl
-	Imports     []string
-	importIndex map[string]struct{} // aka set[string]
-	fset        *token.FileSet
+	PackageName      string
+	PackagePath      string
+	Decls            []Decl
+	Imports          []string
+	ImportedPackages []*Package
+	Instances        []*Instance
+	Skipped          []SkippedDecl
+	importIndex      map[string]struct{} // aka set[string]
+	declIndex        map[types.Object]Decl
+	comments         map[token.Pos]declComments
+	annotations      map[token.Pos]Annotations
+	derivations      map[types.Object]types.Type
+	shifts           map[types.Object]bool
+	anonymous        map[*types.Struct]*types.Named
+	arrayLengths     map[*types.Array]arrayLength
+	order            []Decl
+	cycles           [][]Decl
+	forwardDecls     map[types.Object]bool
+	lock             *IDLock
+	fingerprints     map[types.Object]string
+	diagnostics      Diagnostics
+	types            *types.Package
+	fset             *token.FileSet
 }
 
 // NewPackage creates a new Package that has the given name.  The
 // Package is created with a nil, as opposed to empty, Decls and
-// Imports slices.
-func NewPackage(pkg *types.Package, fset *token.FileSet) *Package {
+// Imports slices. Variables are declared if they have a value, the
+// evaluated initializer, in values.
+func NewPackage(pkg *types.Package, fset *token.FileSet, values map[types.Object]*Value) *Package {
 	p := &Package{
 		PackageName: pkg.Name(),
+		PackagePath: pkg.Path(),
 		importIndex: make(map[string]struct{}),
+		declIndex:   make(map[types.Object]Decl),
+		types:       pkg,
 		fset:        fset,
 	}
 
@@ -44,23 +87,325 @@ func NewPackage(pkg *types.Package, fset *token.FileSet) *Package {
 		return objects[i].Pos() < objects[j].Pos()
 	})
 
+	reasons := skippedObjects(fset, objects, values)
 	for _, obj := range objects {
+		if reason, skipped := reasons[obj]; skipped {
+			p.skip(obj.Pos(), describeObject(obj), reason)
+			continue
+		}
 		switch t := obj.(type) {
 		case *types.Const:
-			p.Declare(NewConstDecl(p, obj))
+			p.declare(obj, NewConstDecl(p, obj))
 		case *types.TypeName:
-			p.Declare(makeDecl(p, t))
+			p.declare(obj, makeDecl(p, t))
+			if named, ok := t.Type().(*types.Named); ok {
+				for i := 0; i < named.NumMethods(); i++ {
+					method := named.Method(i)
+					p.skip(method.Pos(), fmt.Sprintf("method %s.%s", obj.Name(), method.Name()), "methods are not permitted")
+				}
+			}
+		case *types.Var:
+			p.declare(obj, NewValueDecl(p, obj, values[obj]))
+		}
+	}
+	sort.SliceStable(p.Skipped, func(i, j int) bool {
+		a, b := p.Skipped[i].Position, p.Skipped[j].Position
+		return a.Filename < b.Filename || (a.Filename == b.Filename && a.Offset < b.Offset)
+	})
+
+	for _, decl := range p.Decls {
+		if intf, ok := decl.(*InterfaceDecl); ok {
+			intf.resolve()
 		}
 	}
 
 	return p
 }
 
+// errorf records a Diagnostic, at pos, for a problem found while
+// building the receiver's declarations.
+func (p *Package) errorf(pos token.Pos, format string, args ...interface{}) {
+	p.diagnostics = append(p.diagnostics, Diagnostic{p.fset.Position(pos), fmt.Sprintf(format, args...)})
+}
+
+// findInstances records, in declaration order, the distinct
+// instantiations of generic types used by the receiver's declarations.
+// Instantiations with type parameters as arguments, as used within
+// generic declarations, are not recorded.
+func (p *Package) findInstances() {
+	seen := make(map[string]bool)
+	var visit func(t types.Type)
+	visit = func(t types.Type) {
+		switch t := t.(type) {
+		case *types.Named:
+			args := t.TypeArgs()
+			if args.Len() == 0 {
+				return
+			}
+			instance := &Instance{
+				Generic:  p.Lookup(t.Origin().Obj()),
+				TypeName: getTypeName(p, t),
+			}
+			concrete := true
+			for i := 0; i < args.Len(); i++ {
+				visit(args.At(i))
+				concrete = concrete && !hasTypeParams(args.At(i))
+				instance.TypeArgs = append(instance.TypeArgs, getTypeName(p, args.At(i)))
+			}
+			if concrete && !seen[instance.TypeName] {
+				seen[instance.TypeName] = true
+				p.Instances = append(p.Instances, instance)
+			}
+		case *types.Pointer:
+			visit(t.Elem())
+		case *types.Array:
+			visit(t.Elem())
+		case *types.Slice:
+			visit(t.Elem())
+		case *types.Map:
+			visit(t.Key())
+			visit(t.Elem())
+		}
+	}
+	for _, d := range allDecls(p.Decls) {
+		switch d.(type) {
+		case *StructDecl, *InterfaceDecl, *MethodDecl, *ConstDecl:
+			// Their fields and arguments are visited.
+		default:
+			obj := declObject(d)
+			if _, isType := obj.(*types.TypeName); isType {
+				visit(obj.Type().Underlying())
+			} else {
+				visit(obj.Type())
+			}
+		}
+	}
+}
+
+// hasTypeParams returns true if the type t refers to a type parameter.
+func hasTypeParams(t types.Type) bool {
+	switch t := t.(type) {
+	case *types.TypeParam:
+		return true
+	case *types.Named:
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			if hasTypeParams(t.TypeArgs().At(i)) {
+				return true
+			}
+		}
+	case *types.Pointer:
+		return hasTypeParams(t.Elem())
+	case *types.Array:
+		return hasTypeParams(t.Elem())
+	case *types.Slice:
+		return hasTypeParams(t.Elem())
+	case *types.Map:
+		return hasTypeParams(t.Key()) || hasTypeParams(t.Elem())
+	}
+	return false
+}
+
 // Declare appends a Decl to the receiver's collection of declarations.
 func (p *Package) Declare(decl Decl) {
 	p.Decls = append(p.Decls, decl)
 }
 
+func (p *Package) declare(obj types.Object, decl Decl) {
+	p.Declare(decl)
+	p.declIndex[obj] = decl
+}
+
+func (p *Package) skip(pos token.Pos, what, reason string) {
+	p.Skipped = append(p.Skipped, SkippedDecl{p.Position(pos), what, reason})
+}
+
+// skippedObjects returns the reasons the given package-level objects
+// that are not to be declared are skipped. Objects that are not
+// permitted are skipped, as are, transitively, those using the types
+// of skipped objects. Variables are permitted if they have a value,
+// the evaluated initializer, in values.
+func skippedObjects(fset *token.FileSet, objects []types.Object, values map[types.Object]*Value) map[types.Object]string {
+	reasons := make(map[types.Object]string)
+	for _, obj := range objects {
+		if diagnostics := validateObject(fset, obj, values); len(diagnostics) != 0 {
+			messages := make([]string, len(diagnostics))
+			for i, d := range diagnostics {
+				messages[i] = strings.TrimPrefix(d.Message, describeObject(obj)+": ")
+			}
+			reasons[obj] = strings.Join(messages, "; ")
+		} else if _, isVar := obj.(*types.Var); isVar && values[obj] == nil {
+			reasons[obj] = "its initializer cannot be evaluated"
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, obj := range objects {
+			if _, skipped := reasons[obj]; skipped {
+				continue
+			}
+			t := obj.Type()
+			if _, isType := obj.(*types.TypeName); isType {
+				if _, isAlias := t.(*types.Alias); !isAlias {
+					t = t.Underlying()
+				}
+			}
+			if used := usedObject(t, func(obj types.Object) bool { _, skipped := reasons[obj]; return skipped }); used != nil {
+				reasons[obj] = fmt.Sprintf("uses skipped type %s", used.Name())
+				changed = true
+			}
+		}
+	}
+	return reasons
+}
+
+// usedObject returns the object of the first type name used by t for
+// which match returns true, or nil if there is none. Named types are
+// matched, along with their type arguments, but not their definitions.
+func usedObject(t types.Type, match func(types.Object) bool) types.Object {
+	switch t := t.(type) {
+	case *types.Alias:
+		if match(t.Obj()) {
+			return t.Obj()
+		}
+		return usedObject(types.Unalias(t), match)
+	case *types.Named:
+		if match(t.Origin().Obj()) {
+			return t.Origin().Obj()
+		}
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			if used := usedObject(t.TypeArgs().At(i), match); used != nil {
+				return used
+			}
+		}
+	case *types.Pointer:
+		return usedObject(t.Elem(), match)
+	case *types.Array:
+		return usedObject(t.Elem(), match)
+	case *types.Slice:
+		return usedObject(t.Elem(), match)
+	case *types.Map:
+		if used := usedObject(t.Key(), match); used != nil {
+			return used
+		}
+		return usedObject(t.Elem(), match)
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if used := usedObject(t.Field(i).Type(), match); used != nil {
+				return used
+			}
+		}
+	case *types.Interface:
+		for i := 0; i < t.NumEmbeddeds(); i++ {
+			if used := usedObject(t.EmbeddedType(i), match); used != nil {
+				return used
+			}
+		}
+		for i := 0; i < t.NumExplicitMethods(); i++ {
+			if used := usedObject(t.ExplicitMethod(i).Type(), match); used != nil {
+				return used
+			}
+		}
+	case *types.Signature:
+		for _, tuple := range []*types.Tuple{t.Params(), t.Results()} {
+			for i := 0; i < tuple.Len(); i++ {
+				if used := usedObject(tuple.At(i).Type(), match); used != nil {
+					return used
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// describeObject returns a description of a package-level object,
+// e.g. "type Record", for use in diagnostics.
+func describeObject(obj types.Object) string {
+	switch obj.(type) {
+	case *types.Const:
+		return "const " + obj.Name()
+	case *types.TypeName:
+		return "type " + obj.Name()
+	case *types.Func:
+		return "func " + obj.Name()
+	}
+	return "var " + obj.Name()
+}
+
+// Lookup returns the Decl declaring the given types.Object or nil if
+// the object is not declared by the receiver or a package it imports.
+func (p *Package) Lookup(obj types.Object) Decl {
+	if decl, found := p.declIndex[obj]; found {
+		return decl
+	}
+	for _, imported := range p.ImportedPackages {
+		if decl := imported.Lookup(obj); decl != nil {
+			return decl
+		}
+	}
+	return nil
+}
+
+// packageOf returns the model of the given package, the receiver or
+// one it imports, directly or indirectly, or nil if it has none.
+func (p *Package) packageOf(pkg *types.Package) *Package {
+	if pkg == p.types {
+		return p
+	}
+	for _, imported := range p.ImportedPackages {
+		if found := imported.packageOf(pkg); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// qualifier is a types.Qualifier that qualifies the names of types
+// declared in other packages by their package name.
+func (p *Package) qualifier(other *types.Package) string {
+	if other == p.types {
+		return ""
+	}
+	return other.Name()
+}
+
+// typeString returns the Go representation of t, qualified as per the
+// receiver's qualifier, with anonymous structs named and array lengths
+// as written in the source.
+func (p *Package) typeString(t types.Type) string {
+	switch t := t.(type) {
+	case *types.Array:
+		return "[" + p.arrayLength(t) + "]" + p.typeString(t.Elem())
+	case *types.Pointer:
+		return "*" + p.typeString(t.Elem())
+	case *types.Slice:
+		return "[]" + p.typeString(t.Elem())
+	case *types.Map:
+		return "map[" + p.typeString(t.Key()) + "]" + p.typeString(t.Elem())
+	case *types.Named:
+		if t.TypeArgs().Len() != 0 {
+			args := make([]string, t.TypeArgs().Len())
+			for i := range args {
+				args[i] = p.typeString(t.TypeArgs().At(i))
+			}
+			name := t.Obj().Name()
+			if qualifier := p.qualifier(t.Obj().Pkg()); qualifier != "" {
+				name = qualifier + "." + name
+			}
+			return name + "[" + strings.Join(args, ", ") + "]"
+		}
+	}
+	return types.TypeString(p.nameAnonymous(t), p.qualifier)
+}
+
+// arrayLength returns the length of the array type t as written in
+// the receiver's source, or as a number if not known.
+func (p *Package) arrayLength(t *types.Array) string {
+	if length, found := p.arrayLengths[t]; found {
+		return length.expr
+	}
+	return strconv.FormatInt(t.Len(), 10)
+}
+
 // Import appends the name of an imported package to the receiver's
 // collection of imports.
 func (p *Package) Import(path string) {
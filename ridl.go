@@ -9,66 +9,204 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"go/ast"
-	"go/importer"
-	"go/parser"
 	"go/token"
-	"go/types"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 	"time"
 )
 
-func ridlDir(directoryPath string, templateNames []string) error {
-	logdebug("Parsing all .ridl files from directory %q", directoryPath)
-	if filenames, _ := filepath.Glob(filepath.Join(directoryPath, "*.ridl")); filenames == nil {
-		return fmt.Errorf("%s: No .ridl files found in directory", directoryPath)
-	} else {
-		return ridlFiles(directoryPath, filenames, templateNames)
-	}
+// A unit is a set of files, a directory's files or a single named
+// file, processed as one package.
+type unit struct {
+	directory string
+	filenames []string
+	pkg       *Package
 }
 
-func ridlFile(filename string, templateNames []string) error {
-	logdebug("Parsing file %q", filename)
-	if absPath, err := filepath.Abs(filename); err != nil {
+// ridl loads the packages named by args, which may be files,
+// directories or directory patterns, and generates output for each
+// from the named templates. Packages are loaded once, sharing a
+// FileSet and importer, and output is generated in dependency order.
+func ridl(args []string, templateNames []string) error {
+	units, err := findUnits(args)
+	if err != nil {
 		return err
-	} else {
-		return ridlFiles(filepath.Dir(absPath), []string{filename}, templateNames)
 	}
+	if len(units) > 1 && *outputFilename != "" && *outputFilename != StdoutFilename {
+		return fmt.Errorf("-o %s: cannot write the output of %d packages to one file", *outputFilename, len(units))
+	}
+	imp := newRidlImporter(token.NewFileSet(), importSearchPath())
+	var diagnostics Diagnostics
+	for _, u := range units {
+		logdebug("Loading %q from %q", u.filenames, u.directory)
+		u.pkg, err = imp.load(u.directory, u.filenames)
+		var d Diagnostics
+		if errors.As(err, &d) {
+			diagnostics = append(diagnostics, d...)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(diagnostics) != 0 {
+		return append(imp.diagnostics, diagnostics...).unique()
+	}
+	if !*dryRunFlag {
+		loaded := make([]*Package, len(units))
+		for i, u := range units {
+			loaded[i] = u.pkg
+		}
+		if err := writeLocks(loaded); err != nil {
+			return err
+		}
+	}
+	if *fingerprintsFlag {
+		for _, u := range dependencyOrder(units) {
+			if err := printFingerprints(os.Stdout, NewContext(u.directory, u.filenames, u.pkg)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, u := range dependencyOrder(units) {
+		if err := generateOutput(u.pkg, u.directory, u.filenames, templateNames); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func ridlFiles(directory string, filenames []string, templateNames []string) error {
-	if pkg, err := parseFiles(filenames); err == nil {
-		return generateOutput(pkg, directory, filenames, templateNames)
-	} else {
-		return err
+// findUnits returns the units named by args. A directory names the
+// .ridl files within it and a directory followed by "/..." names
+// every directory beneath it, itself included, containing .ridl
+// files. Other arguments name single files.
+func findUnits(args []string) ([]*unit, error) {
+	var units []*unit
+	seen := make(map[string]bool)
+	addDir := func(directory string, filenames []string) {
+		if !seen[directory] {
+			seen[directory] = true
+			units = append(units, &unit{directory: directory, filenames: filenames})
+		}
 	}
+	for _, arg := range args {
+		if root, ok := isPattern(arg); ok {
+			found := false
+			err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !entry.IsDir() {
+					return nil
+				}
+				if path != root && skipDir(entry.Name()) {
+					return filepath.SkipDir
+				}
+				if filenames := ridlFiles(path); filenames != nil {
+					found = true
+					addDir(path, filenames)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				return nil, fmt.Errorf("%s: No .ridl files found matching pattern", arg)
+			}
+		} else if isDir(arg) {
+			filenames := ridlFiles(arg)
+			if filenames == nil {
+				return nil, fmt.Errorf("%s: No .ridl files found in directory", arg)
+			}
+			addDir(filepath.Clean(arg), filenames)
+		} else {
+			absPath, err := filepath.Abs(arg)
+			if err != nil {
+				return nil, err
+			}
+			units = append(units, &unit{directory: filepath.Dir(absPath), filenames: []string{arg}})
+		}
+	}
+	return units, nil
 }
 
-func parseFiles(filenames []string) (*Package, error) {
-	fset := token.NewFileSet()
-	files := make([]*ast.File, 0, len(filenames))
-	for _, filename := range filenames {
-		logdebug("ParseFile %q", filename)
-		file, err := parser.ParseFile(fset, filename, nil, 0)
-		if err != nil {
-			return nil, fmt.Errorf("parse %q: %w", filename, err)
+// isPattern reports whether arg is a directory pattern, a path ending
+// in "/...", and returns the directory at its root.
+func isPattern(arg string) (string, bool) {
+	if arg == "..." {
+		return ".", true
+	}
+	if root := strings.TrimSuffix(filepath.ToSlash(arg), "/..."); root != filepath.ToSlash(arg) {
+		if root == "" {
+			root = "/"
 		}
-		files = append(files, file)
+		return filepath.FromSlash(root), true
 	}
-	conf := types.Config{
-		IgnoreFuncBodies:         true,
-		Importer:                 importer.Default(),
-		DisableUnusedImportCheck: true,
+	return "", false
+}
+
+// skipDir reports whether directories with the given name are ignored
+// when matching patterns. As with the go command these are hidden
+// directories, those beginning with an underscore and testdata.
+func skipDir(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata"
+}
+
+// ridlFiles returns the names of the files processed as the package
+// in the given directory, its .ridl files and, in permissive mode, its
+// Go source files.
+func ridlFiles(directoryPath string) []string {
+	filenames, _ := filepath.Glob(filepath.Join(directoryPath, "*.ridl"))
+	if *permissiveFlag {
+		filenames = append(filenames, goFiles(directoryPath)...)
 	}
-	pkg, err := conf.Check("", fset, files, nil)
-	if err != nil {
-		return nil, fmt.Errorf("type check %q: %w", filenames, err)
+	return filenames
+}
+
+// goFiles returns the names of the Go source files, excluding tests,
+// in the given directory.
+func goFiles(directoryPath string) []string {
+	var filenames []string
+	matches, _ := filepath.Glob(filepath.Join(directoryPath, "*.go"))
+	for _, filename := range matches {
+		if !strings.HasSuffix(filename, "_test.go") {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+// dependencyOrder returns the units ordered so that each follows the
+// units of the packages it imports, directly or indirectly. Units are
+// otherwise kept in the order given.
+func dependencyOrder(units []*unit) []*unit {
+	byPackage := make(map[*Package][]*unit)
+	for _, u := range units {
+		byPackage[u.pkg] = append(byPackage[u.pkg], u)
+	}
+	var ordered []*unit
+	visited := make(map[*Package]bool)
+	var visit func(p *Package)
+	visit = func(p *Package) {
+		if visited[p] {
+			return
+		}
+		visited[p] = true
+		for _, imported := range p.ImportedPackages {
+			visit(imported)
+		}
+		ordered = append(ordered, byPackage[p]...)
+	}
+	for _, u := range units {
+		visit(u.pkg)
 	}
-	return NewPackage(pkg, fset), nil
+	return ordered
 }
 
 func generateOutput(pkg *Package, directory string, filenames []string, templateNames []string) error {
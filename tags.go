@@ -0,0 +1,128 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RidlTagKey is the struct tag key used for ridl's field options.
+const RidlTagKey = "ridl"
+
+// parseTags splits a Go struct tag into its key/value pairs.
+//
+// The tag syntax is that used by reflect.StructTag, a sequence of
+// space-separated key:"value" pairs where each key is a non-empty
+// string of characters other than space, quote and colon, and each
+// value is a Go double-quoted string literal.
+func parseTags(tag string) ([]Tag, error) {
+	var tags []Tag
+	for {
+		tag = strings.TrimLeft(tag, " ")
+		if tag == "" {
+			return tags, nil
+		}
+		i := 0
+		for i < len(tag) && tag[i] > ' ' && tag[i] != ':' && tag[i] != '"' && tag[i] != 0x7f {
+			i++
+		}
+		if i == 0 || i+1 >= len(tag) || tag[i] != ':' || tag[i+1] != '"' {
+			return nil, fmt.Errorf("malformed struct tag %q", tag)
+		}
+		key := tag[:i]
+		tag = tag[i+1:]
+		i = 1
+		for i < len(tag) && tag[i] != '"' {
+			if tag[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(tag) {
+			return nil, fmt.Errorf("unterminated value for struct tag key %q", key)
+		}
+		value, err := strconv.Unquote(tag[:i+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad value for struct tag key %q: %w", key, err)
+		}
+		tags = append(tags, Tag{key, value})
+		tag = tag[i+1:]
+	}
+}
+
+// setTags parses the supplied struct tag into the receiver's Tags
+// and applies the options of any ridl tag.
+func (sf *StructField) setTags(tag string) error {
+	tags, err := parseTags(tag)
+	if err != nil {
+		return err
+	}
+	sf.Tags = tags
+	if sf.HasTag(RidlTagKey) {
+		return sf.parseRidlTag(sf.TagValue(RidlTagKey))
+	}
+	return nil
+}
+
+// checkTag returns an error if a Go struct tag is malformed or has a
+// ridl tag with invalid options.
+func checkTag(tag string) error {
+	var sf StructField
+	return sf.setTags(tag)
+}
+
+// parseRidlTag parses the options of a ridl struct tag. The tag's
+// value is a comma-separated list of options,
+//
+//	name=<identifier>  the field's name on the wire
+//	optional           the field may be omitted
+//	default=<value>    the field's default value
+//	since=<integer>    the protocol version that introduced the field
+//
+// Values may not contain commas.
+func (sf *StructField) parseRidlTag(value string) error {
+	for _, option := range strings.Split(value, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		key, val, hasValue := option, "", false
+		if i := strings.IndexByte(option, '='); i != -1 {
+			key, val, hasValue = option[:i], option[i+1:], true
+		}
+		switch key {
+		case "name":
+			if val == "" {
+				return fmt.Errorf("ridl tag: name option requires a value")
+			}
+			sf.TagName = val
+		case "optional":
+			if hasValue {
+				return fmt.Errorf("ridl tag: optional option does not take a value")
+			}
+			sf.Optional = true
+		case "default":
+			if !hasValue {
+				return fmt.Errorf("ridl tag: default option requires a value")
+			}
+			sf.Default = val
+			sf.HasDefault = true
+		case "since":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return fmt.Errorf("ridl tag: since option requires a non-negative integer, not %q", val)
+			}
+			sf.Since = n
+		default:
+			return fmt.Errorf("ridl tag: unknown option %q", key)
+		}
+	}
+	return nil
+}
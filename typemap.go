@@ -4,8 +4,22 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"strings"
 )
 
+// OptionalGoType is the pseudo Go type used to map optional values,
+// pointers, to C++. The CppType of its mapping is a template in which
+// "%s" is replaced by the C++ type of the pointed-to value.
+const OptionalGoType = "optional"
+
+// ErrorResultGoType is the pseudo Go type used to map the results of
+// methods returning an error to C++. The CppType of its mapping is a
+// template in which "%s" is replaced by the C++ type of the method's
+// other results, or void. The default, "%s", reports errors as
+// exceptions. Other mappings select other idioms, e.g.
+// "std::expected<%s, std::error_code>" or "absl::StatusOr<%s>".
+const ErrorResultGoType = "error-result"
+
 type TypeMap struct {
 	GoType    string `json:"go-type"`
 	CppType   string `json:"cpp-type"`
@@ -37,6 +51,8 @@ var (
 		{"uintptr", "ptrdiff_t", false},
 		{"complex32", "std::complex<float>", false},
 		{"complex64", "std::complex<double>", false},
+		{OptionalGoType, "std::optional<%s>", true},
+		{ErrorResultGoType, "%s", false},
 	}
 )
 
@@ -65,11 +81,23 @@ func readTypeMap(filename string) error {
 	return nil
 }
 
+// mapGoToCpp returns the C++ type, and pass-by-reference flag, for a
+// Go type name. Names of types from other packages, "pkg.Type", that
+// have no mapping are mapped to the C++ qualified name "pkg::Type".
 func mapGoToCpp(goType string) (string, bool) {
 	if t, found := typeMap[goType]; found {
 		return t.CppType, t.PassByRef
 	}
-	return goType, false
+	return strings.ReplaceAll(goType, ".", "::"), false
+}
+
+func mapOptionalToCpp(cppType string) (string, bool) {
+	t := typeMap[OptionalGoType]
+	return strings.ReplaceAll(t.CppType, "%s", cppType), t.PassByRef
+}
+
+func mapErrorResultToCpp(cppType string) string {
+	return strings.ReplaceAll(typeMap[ErrorResultGoType].CppType, "%s", cppType)
 }
 
 func writeTypeMap(w io.Writer) {
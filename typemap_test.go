@@ -53,3 +53,83 @@ func TestTypeMap1(t *testing.T) {
 	}
 
 }
+
+func TestOptionalTypeMap(t *testing.T) {
+	initTypeMap()
+
+	if cpp := mustMap(t, cppType, "*Timestamp"); cpp != "std::optional<Timestamp>" {
+		t.Fatalf("Go %q mapped to C++ %q", "*Timestamp", cpp)
+	}
+	if cpp := mustMap(t, argType, "*string"); cpp != "const std::optional<std::string> &" {
+		t.Fatalf("Go %q mapped to C++ argument type %q", "*string", cpp)
+	}
+
+	typeMap[OptionalGoType] = TypeMap{OptionalGoType, "boost::optional<%s>", true}
+	defer initTypeMap()
+	if cpp := mustMap(t, cppType, "*int32"); cpp != "boost::optional<int32_t>" {
+		t.Fatalf("Go %q mapped to C++ %q", "*int32", cpp)
+	}
+}
+
+func TestNestedCppTypes(t *testing.T) {
+	initTypeMap()
+
+	for goType, expected := range map[string]string{
+		"[][]float32":         "std::vector<std::vector<float>>",
+		"[][4]float32":        "std::vector<std::array<float, 4>>",
+		"map[string][]Item":   "std::map<std::string, std::vector<Item>>",
+		"[4]map[K]V":          "std::array<std::map<K, V>, 4>",
+		"map[[2]int]struct{}": "std::set<std::array<int, 2>>",
+		"[]*map[string]int":   "std::vector<std::optional<std::map<std::string, int>>>",
+		"Pair[string, []T]":   "Pair<std::string, std::vector<T>>",
+	} {
+		if cpp := mustMap(t, cppType, goType); cpp != expected {
+			t.Errorf("Go %q mapped to C++ %q, expected %q", goType, cpp, expected)
+		}
+	}
+}
+
+func TestMalformedCppTypes(t *testing.T) {
+	initTypeMap()
+
+	for _, goType := range []string{"[4", "map[string", "[]func()", "struct{ X int }", "42", ""} {
+		if cpp, err := cppType(goType); err == nil {
+			t.Errorf("Go %q mapped to C++ %q, expected an error", goType, cpp)
+		}
+	}
+	if _, err := cppType(42); err == nil {
+		t.Errorf("an int mapped to C++")
+	}
+	for goType, expected := range map[string]string{"[4]int": "[4]", "[]T": "[]", "T": ""} {
+		if d, err := dims(goType); err != nil || d != expected {
+			t.Errorf("dims of %q are %q (%v), expected %q", goType, d, err, expected)
+		}
+	}
+	if _, err := eltype("[4"); err == nil {
+		t.Errorf("eltype accepted a malformed type")
+	}
+}
+
+// mustMap returns the C++ type a type mapping function maps typ to.
+func mustMap(t *testing.T, mapping func(interface{}) (string, error), typ interface{}) string {
+	t.Helper()
+	cpp, err := mapping(typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cpp
+}
+
+func TestErrorResultTypeMap(t *testing.T) {
+	initTypeMap()
+
+	if cpp := errResult("std::string"); cpp != "std::string" {
+		t.Fatalf("error result of %q mapped to C++ %q", "std::string", cpp)
+	}
+
+	typeMap[ErrorResultGoType] = TypeMap{ErrorResultGoType, "std::expected<%s, std::error_code>", false}
+	defer initTypeMap()
+	if cpp := errResult("void"); cpp != "std::expected<void, std::error_code>" {
+		t.Fatalf("error result of %q mapped to C++ %q", "void", cpp)
+	}
+}
@@ -0,0 +1,228 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"go/types"
+)
+
+// TypeKind is the kind of type a TypeRef refers to.
+type TypeKind int
+
+const (
+	// TypeKindBasic is a predeclared type, e.g. int32 or string.
+	TypeKindBasic TypeKind = iota
+	// TypeKindNamed is a declared type, possibly an instantiated
+	// generic type, or a synthesized struct.
+	TypeKindNamed
+	// TypeKindArray is a fixed length array, [N]T.
+	TypeKindArray
+	// TypeKindSlice is a variable length array, []T.
+	TypeKindSlice
+	// TypeKindMap is a map, map[K]V.
+	TypeKindMap
+	// TypeKindOptional is an optional value, *T.
+	TypeKindOptional
+	// TypeKindParam is a type parameter of a generic type.
+	TypeKindParam
+	// TypeKindStruct is the empty struct, struct{}, the value type
+	// of a map used as a set.
+	TypeKindStruct
+)
+
+func (k TypeKind) String() string {
+	switch k {
+	case TypeKindBasic:
+		return "basic"
+	case TypeKindNamed:
+		return "named"
+	case TypeKindArray:
+		return "array"
+	case TypeKindSlice:
+		return "slice"
+	case TypeKindMap:
+		return "map"
+	case TypeKindOptional:
+		return "optional"
+	case TypeKindParam:
+		return "param"
+	case TypeKindStruct:
+		return "struct"
+	}
+	panic(fmt.Errorf("bad TypeKind value == %d", int(k)))
+}
+
+//  ================================================================
+
+// A TypeRef describes the type of a field, method argument or result,
+// or an element, key or value of a composite type. Composite types
+// refer to the types they are composed of, so templates can examine a
+// type's structure rather than parse its name.
+//
+// Name is the name of a basic, named or type parameter type,
+// unqualified. Elem is the element type of an array, slice or map and
+// the type of an optional value. Key is a map's key type and Len, with
+// LengthExpr, an array's length. Args holds the type arguments of an
+// instantiated generic type.
+type TypeRef struct {
+	pkg        *Package
+	typ        types.Type
+	Kind       TypeKind
+	Name       string
+	Elem       *TypeRef
+	Key        *TypeRef
+	Len        int
+	LengthExpr string
+	Args       []*TypeRef
+}
+
+// typeRef returns the TypeRef describing t as used in the package p.
+// Untyped basic types are described by the name of their kind, e.g.
+// int or float, as by TrimUntyped. It returns an error if t is of a
+// kind, such as a function or channel, that ridl does not support.
+func (p *Package) typeRef(t types.Type) (*TypeRef, error) {
+	ref := &TypeRef{pkg: p, typ: t}
+	var err error
+	switch t := t.(type) {
+	case *types.Basic:
+		ref.Kind, ref.Name = TypeKindBasic, TrimUntyped(t.Name())
+	case *types.Alias:
+		if t.Obj().Pkg() == nil {
+			// A predeclared alias, byte, rune or any.
+			ref.Kind, ref.Name = TypeKindBasic, t.Obj().Name()
+			break
+		}
+		ref.Kind, ref.Name = TypeKindNamed, t.Obj().Name()
+	case *types.Named:
+		ref.Kind, ref.Name = TypeKindNamed, t.Obj().Name()
+		for i := 0; i < t.TypeArgs().Len() && err == nil; i++ {
+			var arg *TypeRef
+			arg, err = p.typeRef(t.TypeArgs().At(i))
+			ref.Args = append(ref.Args, arg)
+		}
+	case *types.TypeParam:
+		ref.Kind, ref.Name = TypeKindParam, t.Obj().Name()
+	case *types.Pointer:
+		ref.Kind = TypeKindOptional
+		ref.Elem, err = p.typeRef(t.Elem())
+	case *types.Array:
+		ref.Kind, ref.Len, ref.LengthExpr = TypeKindArray, int(t.Len()), p.arrayLength(t)
+		ref.Elem, err = p.typeRef(t.Elem())
+	case *types.Slice:
+		ref.Kind = TypeKindSlice
+		ref.Elem, err = p.typeRef(t.Elem())
+	case *types.Map:
+		ref.Kind = TypeKindMap
+		if ref.Key, err = p.typeRef(t.Key()); err == nil {
+			ref.Elem, err = p.typeRef(t.Elem())
+		}
+	case *types.Struct:
+		if named, found := p.anonymous[t]; found {
+			return p.typeRef(named)
+		}
+		ref.Kind = TypeKindStruct
+	default:
+		return nil, fmt.Errorf("%s: %s types are not supported", t, describeType(t))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// TypeName returns the Go representation of the type.
+func (r *TypeRef) TypeName() string {
+	return getTypeName(r.pkg, r.typ)
+}
+
+// String returns the Go representation of the type.
+func (r *TypeRef) String() string {
+	return r.TypeName()
+}
+
+// Decl returns the declaration of a named type, or nil if the type is
+// not named or not declared by a ridl package.
+func (r *TypeRef) Decl() Decl {
+	if obj := r.object(); obj != nil {
+		return r.pkg.Lookup(obj)
+	}
+	return nil
+}
+
+// Package returns the package declaring a named type, or nil if the
+// type is not named or not declared by a ridl package.
+func (r *TypeRef) Package() *Package {
+	if obj := r.object(); obj != nil && obj.Pkg() != nil {
+		return r.pkg.packageOf(obj.Pkg())
+	}
+	return nil
+}
+
+// QualifiedName returns the name of a named type qualified by the name
+// of its package if it is declared in another package, e.g.
+// common.Timestamp.
+func (r *TypeRef) QualifiedName() string {
+	if obj := r.object(); obj != nil && obj.Pkg() != nil {
+		if qualifier := r.pkg.qualifier(obj.Pkg()); qualifier != "" {
+			return qualifier + "." + r.Name
+		}
+	}
+	return r.Name
+}
+
+func (r *TypeRef) object() types.Object {
+	switch t := r.typ.(type) {
+	case *types.Named:
+		return t.Origin().Obj()
+	case *types.Alias:
+		return t.Obj()
+	}
+	return nil
+}
+
+// IsBasic returns true if the type is a predeclared type.
+func (r *TypeRef) IsBasic() bool {
+	return r.Kind == TypeKindBasic
+}
+
+// IsNamed returns true if the type is a declared type.
+func (r *TypeRef) IsNamed() bool {
+	return r.Kind == TypeKindNamed
+}
+
+// IsArray returns true if the type is a fixed length array.
+func (r *TypeRef) IsArray() bool {
+	return r.Kind == TypeKindArray
+}
+
+// IsSlice returns true if the type is a slice.
+func (r *TypeRef) IsSlice() bool {
+	return r.Kind == TypeKindSlice
+}
+
+// IsMap returns true if the type is a map.
+func (r *TypeRef) IsMap() bool {
+	return r.Kind == TypeKindMap
+}
+
+// IsSet returns true if the type is a map whose values are the empty
+// struct, a set of keys.
+func (r *TypeRef) IsSet() bool {
+	return r.Kind == TypeKindMap && r.Elem.Kind == TypeKindStruct
+}
+
+// IsOptional returns true if the type is an optional value.
+func (r *TypeRef) IsOptional() bool {
+	return r.Kind == TypeKindOptional
+}
+
+// IsParam returns true if the type is a type parameter.
+func (r *TypeRef) IsParam() bool {
+	return r.Kind == TypeKindParam
+}
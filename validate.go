@@ -0,0 +1,273 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// A Diagnostic is a message about a problem at a position in the
+// source being processed.
+type Diagnostic struct {
+	Position token.Position
+	Message  string
+}
+
+// String returns the diagnostic in the conventional
+// "file:line:column: message" form.
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Position, d.Message)
+}
+
+// Diagnostics is a collection of Diagnostic values. Diagnostics
+// implements error so problems can be returned together.
+type Diagnostics []Diagnostic
+
+// Error returns the diagnostics, one per line.
+func (d Diagnostics) Error() string {
+	lines := make([]string, len(d))
+	for i := range d {
+		lines[i] = d[i].String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Sort sorts the diagnostics by source position.
+func (d Diagnostics) Sort() {
+	sort.SliceStable(d, func(i, j int) bool {
+		a, b := d[i].Position, d[j].Position
+		return a.Filename < b.Filename || (a.Filename == b.Filename && a.Offset < b.Offset)
+	})
+}
+
+// unique returns the diagnostics, sorted, with duplicates removed.
+// Packages loaded more than once report the same problems each time.
+func (d Diagnostics) unique() Diagnostics {
+	d.Sort()
+	var result Diagnostics
+	seen := make(map[string]bool)
+	for _, diagnostic := range d {
+		if s := diagnostic.String(); !seen[s] {
+			seen[s] = true
+			result = append(result, diagnostic)
+		}
+	}
+	return result
+}
+
+//  ================================================================
+
+// validatePackage checks every declaration in a type-checked package
+// against ridl's restrictions and returns a Diagnostic, in source
+// order, for each violation found. Variables are permitted if they
+// are in values, those initialized by composite literals.
+func validatePackage(pkg *types.Package, fset *token.FileSet, values map[types.Object]*Value) Diagnostics {
+	v := &validator{fset: fset, values: values}
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		obj := scope.Lookup(name)
+		v.checkObject(obj)
+		if named, ok := obj.Type().(*types.Named); ok {
+			if _, isTypeName := obj.(*types.TypeName); isTypeName {
+				for i := 0; i < named.NumMethods(); i++ {
+					method := named.Method(i)
+					v.errorf(method.Pos(), "method %s.%s: methods are not permitted", name, method.Name())
+				}
+			}
+		}
+	}
+	v.diagnostics.Sort()
+	return v.diagnostics
+}
+
+// validateObject returns the violations of ridl's restrictions in the
+// declaration of a single package-level object.
+func validateObject(fset *token.FileSet, obj types.Object, values map[types.Object]*Value) Diagnostics {
+	v := &validator{fset: fset, values: values}
+	v.checkObject(obj)
+	return v.diagnostics
+}
+
+type validator struct {
+	fset        *token.FileSet
+	values      map[types.Object]*Value
+	diagnostics Diagnostics
+}
+
+func (v *validator) errorf(pos token.Pos, format string, args ...interface{}) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{v.fset.Position(pos), fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) checkObject(obj types.Object) {
+	switch obj := obj.(type) {
+	case *types.TypeName:
+		v.checkTypeDecl(obj)
+	case *types.Func:
+		v.errorf(obj.Pos(), "func %s: functions are not permitted", obj.Name())
+	case *types.Var:
+		if _, found := v.values[obj]; found {
+			v.checkValue(obj.Pos(), "var "+obj.Name(), obj.Type())
+			break
+		}
+		v.errorf(obj.Pos(), "var %s: only variables initialized by composite literals are permitted", obj.Name())
+	}
+}
+
+func (v *validator) checkTypeDecl(obj *types.TypeName) {
+	what := "type " + obj.Name()
+	if named, ok := obj.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+		switch named.Underlying().(type) {
+		case *types.Struct, *types.Array, *types.Slice, *types.Map:
+		default:
+			v.errorf(obj.Pos(), "%s: only struct, array, slice and map types may have type parameters", what)
+			return
+		}
+	}
+	switch t := obj.Type().Underlying().(type) {
+	case *types.Basic:
+		v.checkBasic(obj.Pos(), what, t)
+	case *types.Array:
+		v.checkValue(obj.Pos(), what, t.Elem())
+	case *types.Slice:
+		v.checkValue(obj.Pos(), what, t.Elem())
+	case *types.Map:
+		v.checkMap(obj.Pos(), what, t)
+	case *types.Struct:
+		v.checkStruct("field "+obj.Name(), t)
+	case *types.Interface:
+		v.checkInterface(obj, t)
+	default:
+		v.errorf(obj.Pos(), "%s: %s types are not permitted", what, describeType(t))
+	}
+}
+
+// checkStruct checks the fields of a struct type, declared or
+// anonymous. Fields are described as what.name in diagnostics.
+func (v *validator) checkStruct(what string, t *types.Struct) {
+	for i := 0; i < t.NumFields(); i++ {
+		field := t.Field(i)
+		what := what + "." + field.Name()
+		if field.Anonymous() {
+			if _, ok := types.Unalias(field.Type()).(*types.Named); !ok {
+				v.errorf(field.Pos(), "%s: only named types may be embedded", what)
+			}
+		} else {
+			v.checkValue(field.Pos(), what, field.Type())
+		}
+		if err := checkTag(t.Tag(i)); err != nil {
+			v.errorf(field.Pos(), "%s: %v", what, err)
+		}
+	}
+}
+
+func (v *validator) checkInterface(obj *types.TypeName, t *types.Interface) {
+	for i := 0; i < t.NumEmbeddeds(); i++ {
+		if _, ok := t.EmbeddedType(i).Underlying().(*types.Interface); !ok {
+			v.errorf(obj.Pos(), "interface %s: embedded type %s is not an interface", obj.Name(), t.EmbeddedType(i))
+		}
+	}
+	for i := 0; i < t.NumExplicitMethods(); i++ {
+		method := t.ExplicitMethod(i)
+		what := fmt.Sprintf("method %s.%s", obj.Name(), method.Name())
+		signature := method.Type().(*types.Signature)
+		if signature.Variadic() {
+			v.errorf(method.Pos(), "%s: variadic methods are not permitted", what)
+		}
+		for _, tuple := range []*types.Tuple{signature.Params(), signature.Results()} {
+			for j := 0; j < tuple.Len(); j++ {
+				v.checkValue(tuple.At(j).Pos(), what, tuple.At(j).Type())
+			}
+		}
+	}
+}
+
+// checkValue checks the type of a struct field, a method argument or
+// result, or an element, key or value of a composite type. Composite
+// types may be nested to any depth. Pointers represent optional
+// values. Anonymous struct types are named by ridl (see
+// synthesizeStructs).
+func (v *validator) checkValue(pos token.Pos, what string, t types.Type) {
+	switch t := t.(type) {
+	case *types.Basic:
+		v.checkBasic(pos, what, t)
+	case *types.Named:
+		// Named types are checked where they are declared, the
+		// type arguments of instantiations here.
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			v.checkValue(pos, what, t.TypeArgs().At(i))
+		}
+	case *types.Alias:
+		// An alias is checked as the type it names.
+		v.checkValue(pos, what, types.Unalias(t))
+	case *types.TypeParam:
+	case *types.Pointer:
+		if _, ok := types.Unalias(t.Elem()).(*types.Pointer); ok {
+			v.errorf(pos, "%s: pointers to pointers are not permitted", what)
+			return
+		}
+		v.checkValue(pos, what, t.Elem())
+	case *types.Array:
+		v.checkValue(pos, what, t.Elem())
+	case *types.Slice:
+		v.checkValue(pos, what, t.Elem())
+	case *types.Map:
+		v.checkMap(pos, what, t)
+	case *types.Struct:
+		v.checkStruct(what, t)
+	default:
+		v.errorf(pos, "%s: %s types are not permitted", what, describeType(t))
+	}
+}
+
+func (v *validator) checkMap(pos token.Pos, what string, t *types.Map) {
+	if _, ok := types.Unalias(t.Key()).(*types.Pointer); ok {
+		v.errorf(pos, "%s: map keys may not be optional", what)
+	} else {
+		v.checkValue(pos, what, t.Key())
+	}
+	if s, ok := t.Elem().(*types.Struct); ok && s.NumFields() == 0 {
+		return // a set
+	}
+	v.checkValue(pos, what, t.Elem())
+}
+
+func (v *validator) checkBasic(pos token.Pos, what string, t *types.Basic) {
+	if t.Kind() == types.UnsafePointer {
+		v.errorf(pos, "%s: unsafe.Pointer is not permitted", what)
+	}
+}
+
+// describeType returns a short description of the kind of type t,
+// for use in diagnostics.
+func describeType(t types.Type) string {
+	switch t.(type) {
+	case *types.Chan:
+		return "channel"
+	case *types.Signature:
+		return "function"
+	case *types.Pointer:
+		return "pointer"
+	case *types.Array:
+		return "array"
+	case *types.Slice:
+		return "slice"
+	case *types.Map:
+		return "map"
+	case *types.Struct:
+		return "anonymous struct"
+	case *types.Interface:
+		return "interface"
+	case *types.TypeParam:
+		return "type parameter"
+	}
+	return fmt.Sprintf("%T", t)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const source = `package test
+
+type C chan int
+
+type S struct {
+	Ch chan int
+	X  **int
+	Ok *int
+}
+
+type I interface {
+	M(f func(), n ...int) error
+}
+
+func G() {}
+
+var V = len("x")
+
+var W = S{Ok: f()}
+
+func f() *int { return nil }
+`
+	_, err := checkSource(t, source)
+	var diagnostics Diagnostics
+	if !errors.As(err, &diagnostics) {
+		t.Fatalf("expected Diagnostics, got %v", err)
+	}
+	expected := []struct {
+		line, column int
+		message      string
+	}{
+		{3, 6, "type C: channel types are not permitted"},
+		{6, 2, "field S.Ch: channel types are not permitted"},
+		{7, 2, "field S.X: pointers to pointers are not permitted"},
+		{12, 2, "method I.M: variadic methods are not permitted"},
+		{12, 4, "method I.M: function types are not permitted"},
+		{15, 6, "func G: functions are not permitted"},
+		{17, 5, "var V: only variables initialized by composite literals are permitted"},
+		{19, 15, "var W: only constants and composite literals are permitted in initializers"},
+		{21, 6, "func f: functions are not permitted"},
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("got %d diagnostics, expected %d:\n%v", len(diagnostics), len(expected), diagnostics)
+	}
+	for i, e := range expected {
+		d := diagnostics[i]
+		if d.Position.Line != e.line || d.Position.Column != e.column || d.Message != e.message {
+			t.Errorf("diagnostic #%d: got %q, expected %d:%d: %s", i+1, d, e.line, e.column, e.message)
+		}
+	}
+}
+
+func TestValidateAliases(t *testing.T) {
+	const source = `package test
+
+type Name = string
+
+type Any = interface{}
+
+type S struct {
+	N Name
+	A any
+	M map[string]any
+	P *Any
+	L []Name
+}
+`
+	_, err := checkSource(t, source)
+	var diagnostics Diagnostics
+	if !errors.As(err, &diagnostics) {
+		t.Fatalf("expected Diagnostics, got %v", err)
+	}
+	expected := []string{
+		"field S.A: interface types are not permitted",
+		"field S.M: interface types are not permitted",
+		"field S.P: interface types are not permitted",
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("got %d diagnostics, expected %d:\n%v", len(diagnostics), len(expected), diagnostics)
+	}
+	for i, message := range expected {
+		if diagnostics[i].Message != message {
+			t.Errorf("diagnostic #%d is %q, expected %q", i+1, diagnostics[i].Message, message)
+		}
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	source := "package test\n\n" +
+		"type S struct {\n" +
+		"\tA int32 `ridl:\"bogus\"`\n" +
+		"\tB int32 `json:\"b\" ridl:\"name=b,optional\"`\n" +
+		"\tC int32 `ridl:\"default\"`\n" +
+		"\tD struct {\n" +
+		"\t\tE int32 `ridl:\"since=-1\"`\n" +
+		"\t}\n" +
+		"\tF int32 `ridl:\"name`\n" +
+		"}\n"
+	_, err := checkSource(t, source)
+	var diagnostics Diagnostics
+	if !errors.As(err, &diagnostics) {
+		t.Fatalf("expected Diagnostics, got %v", err)
+	}
+	expected := []struct {
+		line, column int
+		message      string
+	}{
+		{4, 2, `field S.A: ridl tag: unknown option "bogus"`},
+		{6, 2, "field S.C: ridl tag: default option requires a value"},
+		{8, 3, `field S.D.E: ridl tag: since option requires a non-negative integer, not "-1"`},
+		{10, 2, `field S.F: unterminated value for struct tag key "ridl"`},
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("got %d diagnostics, expected %d:\n%v", len(diagnostics), len(expected), diagnostics)
+	}
+	for i, e := range expected {
+		d := diagnostics[i]
+		if d.Position.Line != e.line || d.Position.Column != e.column || d.Message != e.message {
+			t.Errorf("diagnostic #%d: got %q, expected %d:%d: %s", i+1, d, e.line, e.column, e.message)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// ridl - re-targetable IDL compiler
+// Copyright © 2016 A.Newman.
+//
+// This file is licensed using the GNU Public License, version 2.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"strconv"
+)
+
+// A package-level variable initialized by a composite literal, e.g.
+//
+//	var DefaultConfig = Config{Retries: 3, Timeout: 5}
+//
+// declares a value that templates may use to emit constants and
+// default member initializers. The initializer is evaluated from the
+// source into a tree of Values. Other variables are not permitted.
+
+// A ValueDecl represents a package-level variable initialized by a
+// composite literal.
+type ValueDecl struct {
+	decl
+	Value *Value
+}
+
+// NewValueDecl returns a new ValueDecl with the given value.
+func NewValueDecl(pkg *Package, obj types.Object, value *Value) *ValueDecl {
+	value.setPackage(pkg)
+	return &ValueDecl{decl{pkg, obj, DeclKindValue}, value}
+}
+
+//  ================================================================
+
+// ValueKind is the kind of a Value.
+type ValueKind int
+
+const (
+	// ValueKindZero is the zero value of a type, a field omitted
+	// from a struct literal or nil.
+	ValueKindZero ValueKind = iota
+	// ValueKindBasic is a constant of a basic type.
+	ValueKindBasic
+	// ValueKindStruct is a struct literal.
+	ValueKindStruct
+	// ValueKindArray is an array or slice literal.
+	ValueKindArray
+	// ValueKindMap is a map literal.
+	ValueKindMap
+)
+
+// A Value is a node in the tree of values making up the initializer
+// of a ValueDecl. Basic values hold their constant value in Const,
+// struct values a FieldValue for each field, in declaration order,
+// array and slice values their elements and map values their entries
+// in source order.
+type Value struct {
+	pkg     *Package
+	typ     types.Type
+	Kind    ValueKind
+	Const   constant.Value
+	Fields  []*FieldValue
+	Elems   []*Value
+	Entries []*MapEntry
+}
+
+// A FieldValue is the value of a field in a struct value. IsSet is
+// false if the field is omitted from the literal and has its zero
+// value.
+type FieldValue struct {
+	Name  string
+	Value *Value
+	IsSet bool
+}
+
+// A MapEntry is a key and its value in a map value.
+type MapEntry struct {
+	Key   *Value
+	Value *Value
+}
+
+// TypeName returns the Go representation of the value's type.
+func (v *Value) TypeName() string {
+	return getTypeName(v.pkg, v.typ)
+}
+
+// Literal returns a basic value as a literal, strings quoted as in
+// Go and C. It returns an empty string for other values.
+func (v *Value) Literal() string {
+	if v.Kind != ValueKindBasic {
+		return ""
+	}
+	switch v.Const.Kind() {
+	case constant.String:
+		return strconv.Quote(constant.StringVal(v.Const))
+	case constant.Float:
+		f, _ := constant.Float64Val(v.Const)
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return v.Const.ExactString()
+}
+
+// IsZero returns true if the value is the zero value of its type.
+func (v *Value) IsZero() bool {
+	return v.Kind == ValueKindZero
+}
+
+// IsBasic returns true if the value is a constant of a basic type.
+func (v *Value) IsBasic() bool {
+	return v.Kind == ValueKindBasic
+}
+
+// IsStruct returns true if the value is a struct value.
+func (v *Value) IsStruct() bool {
+	return v.Kind == ValueKindStruct
+}
+
+// IsArray returns true if the value is an array or slice value.
+func (v *Value) IsArray() bool {
+	return v.Kind == ValueKindArray
+}
+
+// IsMap returns true if the value is a map value.
+func (v *Value) IsMap() bool {
+	return v.Kind == ValueKindMap
+}
+
+func (v *Value) setPackage(pkg *Package) {
+	v.pkg = pkg
+	for _, f := range v.Fields {
+		f.Value.setPackage(pkg)
+	}
+	for _, e := range v.Elems {
+		e.setPackage(pkg)
+	}
+	for _, e := range v.Entries {
+		e.Key.setPackage(pkg)
+		e.Value.setPackage(pkg)
+	}
+}
+
+//  ================================================================
+
+// collectValues evaluates the initializers of the package-level
+// variables, in the given files, initialized by composite literals.
+// The result holds an entry for each such variable, nil if its
+// initializer could not be evaluated, and a Diagnostic is returned
+// for each initializer that could not.
+func collectValues(fset *token.FileSet, files []*ast.File, info *types.Info) (map[types.Object]*Value, Diagnostics) {
+	e := &evaluator{fset: fset, info: info}
+	values := make(map[types.Object]*Value)
+	for _, file := range files {
+		for _, d := range file.Decls {
+			gen, ok := d.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.ValueSpec)
+				if len(spec.Values) != len(spec.Names) {
+					continue
+				}
+				for i, name := range spec.Names {
+					lit, ok := ast.Unparen(spec.Values[i]).(*ast.CompositeLit)
+					obj := info.Defs[name]
+					if !ok || obj == nil {
+						continue
+					}
+					e.what = "var " + name.Name
+					before := len(e.diagnostics)
+					value := e.eval(lit, obj.Type())
+					if len(e.diagnostics) != before {
+						value = nil
+					}
+					values[obj] = value
+				}
+			}
+		}
+	}
+	return values, e.diagnostics
+}
+
+type evaluator struct {
+	fset        *token.FileSet
+	info        *types.Info
+	what        string
+	diagnostics Diagnostics
+}
+
+func (e *evaluator) errorf(pos token.Pos, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	e.diagnostics = append(e.diagnostics, Diagnostic{e.fset.Position(pos), e.what + ": " + message})
+}
+
+// eval returns the Value of expr, an expression of type t.
+func (e *evaluator) eval(expr ast.Expr, t types.Type) *Value {
+	expr = ast.Unparen(expr)
+	tv := e.info.Types[expr]
+	if tv.Value != nil {
+		return &Value{typ: t, Kind: ValueKindBasic, Const: tv.Value}
+	}
+	if tv.IsNil() {
+		return &Value{typ: t, Kind: ValueKindZero}
+	}
+	lit, ok := expr.(*ast.CompositeLit)
+	if !ok {
+		e.errorf(expr.Pos(), "only constants and composite literals are permitted in initializers")
+		return &Value{typ: t, Kind: ValueKindZero}
+	}
+	t = tv.Type
+	switch u := t.Underlying().(type) {
+	case *types.Struct:
+		return e.evalStruct(lit, t, u)
+	case *types.Array:
+		return e.evalArray(lit, t, u.Elem())
+	case *types.Slice:
+		return e.evalArray(lit, t, u.Elem())
+	case *types.Map:
+		value := &Value{typ: t, Kind: ValueKindMap}
+		for _, elt := range lit.Elts {
+			kv := elt.(*ast.KeyValueExpr)
+			value.Entries = append(value.Entries, &MapEntry{e.eval(kv.Key, u.Key()), e.eval(kv.Value, u.Elem())})
+		}
+		return value
+	}
+	e.errorf(lit.Pos(), "%s literals are not permitted", describeType(t.Underlying()))
+	return &Value{typ: t, Kind: ValueKindZero}
+}
+
+func (e *evaluator) evalStruct(lit *ast.CompositeLit, t types.Type, s *types.Struct) *Value {
+	value := &Value{typ: t, Kind: ValueKindStruct}
+	for i := 0; i < s.NumFields(); i++ {
+		field := s.Field(i)
+		value.Fields = append(value.Fields, &FieldValue{field.Name(), &Value{typ: field.Type(), Kind: ValueKindZero}, false})
+	}
+	for i, elt := range lit.Elts {
+		index := i
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			name := kv.Key.(*ast.Ident).Name
+			for j := range value.Fields {
+				if value.Fields[j].Name == name {
+					index = j
+				}
+			}
+			elt = kv.Value
+		}
+		f := value.Fields[index]
+		f.Value, f.IsSet = e.eval(elt, s.Field(index).Type()), true
+	}
+	return value
+}
+
+func (e *evaluator) evalArray(lit *ast.CompositeLit, t, elem types.Type) *Value {
+	value := &Value{typ: t, Kind: ValueKindArray}
+	index := 0
+	for _, elt := range lit.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			n, _ := constant.Int64Val(e.info.Types[kv.Key].Value)
+			index = int(n)
+			elt = kv.Value
+		}
+		for len(value.Elems) <= index {
+			value.Elems = append(value.Elems, &Value{typ: elem, Kind: ValueKindZero})
+		}
+		value.Elems[index] = e.eval(elt, elem)
+		index++
+	}
+	return value
+}